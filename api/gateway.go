@@ -10,8 +10,9 @@ import (
 
 // GatewayGET contains the fields returned by a GET call to "/gateway".
 type GatewayGET struct {
-	NetAddress modules.NetAddress `json:"netaddress"`
-	Peers      []modules.Peer     `json:"peers"`
+	NetAddress     modules.NetAddress            `json:"netaddress"`
+	Peers          []modules.Peer                `json:"peers"`
+	NetworkMetrics modules.GatewayNetworkMetrics `json:"networkmetrics"`
 }
 
 // gatewayHandler handles the API call asking for the gatway status.
@@ -23,7 +24,7 @@ func (api *API) gatewayHandler(w http.ResponseWriter, req *http.Request, _ httpr
 	if peers == nil {
 		peers = make([]modules.Peer, 0)
 	}
-	WriteJSON(w, GatewayGET{api.gateway.Address(), peers})
+	WriteJSON(w, GatewayGET{api.gateway.Address(), peers, api.gateway.NetworkMetrics()})
 }
 
 // gatewayConnectHandler handles the API call to add a peer to the gateway.
@@ -25,6 +25,12 @@ func TestGatewayStatus(t *testing.T) {
 	if len(info.Peers) != 0 {
 		t.Fatal("/gateway gave bad peer list:", info.Peers)
 	}
+	if info.NetworkMetrics.Peers != 0 {
+		t.Fatal("/gateway gave bad peer count:", info.NetworkMetrics.Peers)
+	}
+	if info.NetworkMetrics.RPCCalls == nil {
+		t.Fatal("/gateway did not report rpc calls")
+	}
 }
 
 // TestGatewayPeerConnect checks that /gateway/connect is adding a peer to the
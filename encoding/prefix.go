@@ -1,48 +1,113 @@
 package encoding
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 )
 
+// maxPooledBufSize is the largest buffer that ReadObject returns to bufPool.
+// Larger buffers are left to the garbage collector so that a single large
+// object does not pin its memory for the life of the process.
+const maxPooledBufSize = 1 << 16
+
+// bufPool holds the buffers that ReadObject reads encoded objects into.
+// Unmarshal copies everything it decodes, so a buffer can be reused as soon as
+// decoding finishes.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// ErrPrefixTooLong is returned by ReadPrefix and ReadObject when a length
+// prefix exceeds the caller's maximum length. A peer that sends such a prefix
+// is violating the protocol, as opposed to suffering a transport failure.
+// The returned error wraps ErrPrefixTooLong and should be checked with
+// errors.Is.
+var ErrPrefixTooLong = errors.New("length prefix exceeds maxLen")
+
+// prefixTooLongError reports the offending length and maximum while still
+// matching ErrPrefixTooLong.
+type prefixTooLongError struct {
+	length, maxLen uint64
+}
+
+func (e prefixTooLongError) Error() string {
+	return fmt.Sprintf("length %d exceeds maxLen of %d", e.length, e.maxLen)
+}
+
+func (e prefixTooLongError) Unwrap() error { return ErrPrefixTooLong }
+
 // ReadPrefix reads an 8-byte length prefixes, followed by the number of bytes
-// specified in the prefix. The operation is aborted if the prefix exceeds a
-// specified maximum length.
+// specified in the prefix. The operation is aborted with ErrPrefixTooLong if
+// the prefix exceeds a specified maximum length. A missing or truncated prefix
+// or body is reported as io.EOF or io.ErrUnexpectedEOF.
 func ReadPrefix(r io.Reader, maxLen uint64) ([]byte, error) {
-	prefix := make([]byte, 8)
+	return readPrefixInto(r, maxLen, nil)
+}
+
+// readPrefixInto is ReadPrefix, but it reads into buf if buf has enough
+// capacity. The 8-byte prefix is read into buf as well.
+func readPrefixInto(r io.Reader, maxLen uint64, buf []byte) ([]byte, error) {
+	if cap(buf) < 8 {
+		buf = make([]byte, 8)
+	}
+	prefix := buf[:8]
 	if _, err := io.ReadFull(r, prefix); err != nil {
 		return nil, err
 	}
 	dataLen := DecUint64(prefix)
 	if dataLen > maxLen {
-		return nil, fmt.Errorf("length %d exceeds maxLen of %d", dataLen, maxLen)
+		return nil, prefixTooLongError{dataLen, maxLen}
 	}
 	// read dataLen bytes
-	data := make([]byte, dataLen)
+	var data []byte
+	if uint64(cap(buf)) >= dataLen {
+		data = buf[:dataLen]
+	} else {
+		data = make([]byte, dataLen)
+	}
 	_, err := io.ReadFull(r, data)
 	return data, err
 }
 
-// ReadObject reads and decodes a length-prefixed and marshalled object.
+// ReadObject reads and decodes a length-prefixed and marshalled object. The
+// encoded object is read into a pooled buffer, so reading many small objects
+// does not allocate a new buffer for each one.
 func ReadObject(r io.Reader, obj interface{}, maxLen uint64) error {
-	data, err := ReadPrefix(r, maxLen)
-	if err != nil {
-		return err
+	bp := bufPool.Get().(*[]byte)
+	data, err := readPrefixInto(r, maxLen, *bp)
+	if err == nil {
+		err = Unmarshal(data, obj)
+	}
+	if cap(data) > cap(*bp) && cap(data) <= maxPooledBufSize {
+		*bp = data
+	}
+	bufPool.Put(bp)
+	return err
+}
+
+// writeFull writes all of b to w, retrying short writes until either every
+// byte has been written or w returns an error.
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		} else if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
 	}
-	return Unmarshal(data, obj)
+	return nil
 }
 
 // WritePrefix writes a length-prefixed byte slice to w.
 func WritePrefix(w io.Writer, data []byte) error {
-	err := WriteInt(w, len(data))
-	if err != nil {
+	if err := writeFull(w, EncUint64(uint64(len(data)))); err != nil {
 		return err
 	}
-	n, err := w.Write(data)
-	if err == nil && n != len(data) {
-		err = io.ErrShortWrite
-	}
-	return err
+	return writeFull(w, data)
 }
 
 // WriteObject writes a length-prefixed object to w.
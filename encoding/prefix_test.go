@@ -2,6 +2,7 @@ package encoding
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"testing"
 )
@@ -16,6 +17,18 @@ type badWriter struct{}
 
 func (bw *badWriter) Write([]byte) (int, error) { return 0, nil }
 
+// trickleWriter writes at most one byte per call without returning an error.
+type trickleWriter struct {
+	bytes.Buffer
+}
+
+func (tw *trickleWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return tw.Buffer.Write(b[:1])
+}
+
 func TestReadPrefix(t *testing.T) {
 	b := new(bytes.Buffer)
 
@@ -54,6 +67,15 @@ func TestReadPrefix(t *testing.T) {
 	_, err = ReadPrefix(b, 3)
 	if err == nil || err.Error() != "length 4 exceeds maxLen of 3" {
 		t.Error("expected maxLen error, got", err)
+	} else if !errors.Is(err, ErrPrefixTooLong) {
+		t.Error("expected error to match ErrPrefixTooLong, got", err)
+	}
+
+	// lengths that need more than 4 bytes must not be truncated
+	b.Write(EncUint64(1<<32 + 3))
+	_, err = ReadPrefix(b, 3)
+	if err == nil || err.Error() != "length 4294967299 exceeds maxLen of 3" {
+		t.Error("expected maxLen error, got", err)
 	}
 
 	// no data after length prefix
@@ -85,6 +107,13 @@ func TestReadObject(t *testing.T) {
 		t.Error("expected EOF, got", err)
 	}
 
+	// exceed maxLen
+	b.Write(EncUint64(4))
+	err = ReadObject(b, &obj, 3)
+	if !errors.Is(err, ErrPrefixTooLong) {
+		t.Error("expected ErrPrefixTooLong, got", err)
+	}
+
 	// bad object
 	b.Write(EncUint64(3))
 	b.WriteString("foo") // strings need an additional length prefix
@@ -112,6 +141,15 @@ func TestWritePrefix(t *testing.T) {
 	if err != io.ErrShortWrite {
 		t.Error("expected ErrShortWrite, got", err)
 	}
+
+	// trickleWriter (short writes should be retried)
+	tw := new(trickleWriter)
+	err = WritePrefix(tw, []byte("foo"))
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(tw.Bytes(), expected) {
+		t.Errorf("WritePrefix wrote wrong data: expected %v, got %v", expected, tw.Bytes())
+	}
 }
 
 func TestWriteObject(t *testing.T) {
@@ -164,3 +202,73 @@ func TestReadWritePrefix(t *testing.T) {
 		t.Errorf("read/write mismatch: wrote %s, read %s", obj, robj)
 	}
 }
+
+// TestReadObjectReusesBuffer checks that objects decoded by ReadObject do not
+// share memory with the pooled buffer they were read from.
+func TestReadObjectReusesBuffer(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := WriteObject(b, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteObject(b, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	var first, second []byte
+	if err := ReadObject(b, &first, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadObject(b, &second, 100); err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != "foo" || string(second) != "bar" {
+		t.Fatalf("expected foo and bar, got %s and %s", first, second)
+	}
+}
+
+// benchPrefixObject is a small object similar to the messages exchanged by
+// the gateway.
+type benchPrefixObject struct {
+	ID    [32]byte
+	Nodes []string
+}
+
+// BenchmarkReadPrefixUnmarshal measures reading an object without a pooled
+// buffer, by calling ReadPrefix and Unmarshal directly.
+func BenchmarkReadPrefixUnmarshal(b *testing.B) {
+	msg := EncUint64(0)
+	msg = append(msg, Marshal(benchPrefixObject{Nodes: []string{"1.2.3.4:9981", "5.6.7.8:9981"}})...)
+	copy(msg, EncUint64(uint64(len(msg)-8)))
+	r := bytes.NewReader(msg)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(msg)
+		data, err := ReadPrefix(r, 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var obj benchPrefixObject
+		if err := Unmarshal(data, &obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(len(msg)))
+}
+
+// BenchmarkReadObject measures reading an object with ReadObject, which reuses
+// pooled buffers.
+func BenchmarkReadObject(b *testing.B) {
+	msg := EncUint64(0)
+	msg = append(msg, Marshal(benchPrefixObject{Nodes: []string{"1.2.3.4:9981", "5.6.7.8:9981"}})...)
+	copy(msg, EncUint64(uint64(len(msg)-8)))
+	r := bytes.NewReader(msg)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(msg)
+		var obj benchPrefixObject
+		if err := ReadObject(r, &obj, 1000); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(len(msg)))
+}
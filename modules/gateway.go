@@ -72,6 +72,20 @@ type (
 		Version    string     `json:"version"`
 	}
 
+	// GatewayNetworkMetrics reports the network activity of the gateway. RPC
+	// calls are keyed by the first 8 bytes of the RPC name. Calls to RPCs
+	// without a registered handler are counted in UnknownRPCCalls. ActiveRPCs
+	// is the number of incoming RPCs that are currently being handled.
+	GatewayNetworkMetrics struct {
+		ActiveRPCs      uint64            `json:"activerpcs"`
+		BytesRead       uint64            `json:"bytesread"`
+		BytesWritten    uint64            `json:"byteswritten"`
+		RPCCalls        map[string]uint64 `json:"rpccalls"`
+		UnknownRPCCalls uint64            `json:"unknownrpccalls"`
+		Nodes           int               `json:"nodes"`
+		Peers           int               `json:"peers"`
+	}
+
 	// A PeerConn is the connection type used when communicating with peers during
 	// an RPC. It is identical to a net.Conn with the additional RPCAddr method.
 	// This method acts as an identifier for peers and is the address that the
@@ -106,6 +120,10 @@ type (
 		// Peers returns the addresses that the Gateway is currently connected to.
 		Peers() []Peer
 
+		// NetworkMetrics returns the gateway's bandwidth usage, RPC call
+		// counts, and node and peer counts.
+		NetworkMetrics() GatewayNetworkMetrics
+
 		// RegisterRPC registers a function to handle incoming connections that
 		// supply the given RPC ID.
 		RegisterRPC(string, RPCFunc)
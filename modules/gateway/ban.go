@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"errors"
+
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+var (
+	errBannedHost   = errors.New("host has been banned")
+	errFilteredHost = errors.New("address was rejected by the peer filter")
+)
+
+// isBanned returns true if the host of addr has been banned.
+func (g *Gateway) isBanned(addr modules.NetAddress) bool {
+	_, banned := g.bannedHosts[addr.Host()]
+	return banned
+}
+
+// isFiltered returns true if a peer filter is set and it rejects addr.
+func (g *Gateway) isFiltered(addr modules.NetAddress) bool {
+	return g.peerFilter != nil && !g.peerFilter(addr)
+}
+
+// SetPeerFilter sets a function that decides which addresses the gateway may
+// add to its node list, connect to, and accept connections from. Addresses
+// for which filter returns false are treated like banned hosts. Existing
+// nodes and peers are not affected. Passing nil removes the filter, which is
+// the default. filter is called while the gateway's lock is held, so it must
+// not call methods on the gateway.
+func (g *Gateway) SetPeerFilter(filter func(modules.NetAddress) bool) {
+	g.mu.Lock()
+	g.peerFilter = filter
+	g.mu.Unlock()
+}
+
+// Ban prevents the gateway from communicating with the host of addr. Any
+// nodes or peers on that host are removed, future connections to and from the
+// host are refused, and the host will not be added to the node list. Bans are
+// not persisted across restarts.
+func (g *Gateway) Ban(addr modules.NetAddress) error {
+	if err := g.threads.Add(); err != nil {
+		return err
+	}
+	defer g.threads.Done()
+
+	host := canonicalAddr(addr).Host()
+	if host == "" {
+		return errors.New("cannot ban invalid address " + string(addr))
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.bannedHosts[host] = struct{}{}
+	for node := range g.nodes {
+		if node.Host() == host {
+			delete(g.nodes, node)
+		}
+	}
+	for peerAddr, p := range g.peers {
+		if peerAddr.Host() == host {
+			delete(g.peers, peerAddr)
+			if err := p.sess.Close(); err != nil {
+				g.log.Debugf("WARN: error disconnecting from banned peer %q: %v", peerAddr, err)
+			}
+		}
+	}
+	g.log.Println("INFO: banned host", host)
+	return nil
+}
+
+// Unban lifts a ban on the host of addr.
+func (g *Gateway) Unban(addr modules.NetAddress) error {
+	if err := g.threads.Add(); err != nil {
+		return err
+	}
+	defer g.threads.Done()
+
+	addr = canonicalAddr(addr)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.isBanned(addr) {
+		return errors.New("host is not banned: " + addr.Host())
+	}
+	delete(g.bannedHosts, addr.Host())
+	g.log.Println("INFO: unbanned host", addr.Host())
+	return nil
+}
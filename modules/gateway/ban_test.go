@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// TestBan checks that a banned host is removed from the node list, is not
+// re-added through node sharing, and cannot form connections with the gateway
+// in either direction until it is unbanned.
+func TestBan(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	// Ban dummyNode. It should be removed from the node list and not be
+	// re-added when g2 shares it.
+	g1.mu.Lock()
+	err := g1.addNode(dummyNode)
+	g1.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Ban(dummyNode); err != nil {
+		t.Fatal(err)
+	}
+	g1.mu.RLock()
+	_, exists := g1.nodes[dummyNode]
+	g1.mu.RUnlock()
+	if exists {
+		t.Fatal("banned node was not removed from the node list")
+	}
+	g2.mu.Lock()
+	err = g2.addNode(dummyNode)
+	g2.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	g1.mu.Lock()
+	err = g1.addNode(dummyNode)
+	g1.mu.Unlock()
+	if err != errBannedHost {
+		t.Fatalf("expected %v, got %v", errBannedHost, err)
+	}
+
+	// Ban g2. g1 should drop the peer and refuse connections in both
+	// directions.
+	if err := g1.Ban(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if len(g1.Peers()) != 0 {
+		t.Fatal("banned peer was not disconnected")
+	}
+	if err := g1.Connect(g2.Address()); err != errBannedHost {
+		t.Fatalf("expected %v, got %v", errBannedHost, err)
+	}
+	if err := g2.Connect(g1.Address()); err == nil {
+		t.Fatal("banned host was able to connect")
+	}
+
+	// After unbanning, connections should succeed again.
+	if err := g1.Unban(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Unban(g2.Address()); err == nil {
+		t.Fatal("expected error when unbanning a host that is not banned")
+	}
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPeerFilter checks that addresses rejected by the peer filter are kept
+// out of the node list and cannot form connections with the gateway.
+func TestPeerFilter(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	_, blocked, err := net.ParseCIDR("111.111.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g1.SetPeerFilter(func(addr modules.NetAddress) bool {
+		ip := net.ParseIP(addr.Host())
+		return ip != nil && !blocked.Contains(ip) && !ip.IsLoopback()
+	})
+
+	g1.mu.Lock()
+	err = g1.addNode("111.111.1.1:9981")
+	g1.mu.Unlock()
+	if err != errFilteredHost {
+		t.Fatalf("expected %v, got %v", errFilteredHost, err)
+	}
+	g1.mu.Lock()
+	err = g1.addNode("222.222.222.222:9981")
+	g1.mu.Unlock()
+	if err != nil {
+		t.Fatal("filter rejected an allowed address:", err)
+	}
+
+	// g2 listens on a loopback address, so it is rejected in both directions.
+	if err := g1.Connect(g2.Address()); err != errFilteredHost {
+		t.Fatalf("expected %v, got %v", errFilteredHost, err)
+	}
+	if err := g2.Connect(g1.Address()); err == nil {
+		t.Fatal("filtered host was able to connect")
+	}
+
+	// Removing the filter allows connections again.
+	g1.SetPeerFilter(nil)
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,12 +1,24 @@
 package gateway
 
 import (
+	"errors"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/NebulousLabs/Sia/modules"
 )
 
+// errCustomDialer is returned by lookups that cannot be routed through a
+// custom Dialer, and are therefore skipped while one is set.
+var errCustomDialer = errors.New("lookup would bypass the custom dialer")
+
+// A Dialer establishes outbound connections on behalf of the gateway. The
+// Dialer returned by golang.org/x/net/proxy.SOCKS5 satisfies this interface.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
 // peerConn is a simple type that implements the modules.PeerConn interface.
 type peerConn struct {
 	net.Conn
@@ -19,18 +31,155 @@ func (pc peerConn) RPCAddr() modules.NetAddress {
 	return pc.dialbackAddr
 }
 
+// meteredConn wraps a net.Conn. It counts the bytes that pass through it
+// towards the gateway's network metrics and applies the gateway's rate limits.
+type meteredConn struct {
+	net.Conn
+	g *Gateway
+}
+
+// Read implements the io.Reader interface.
+func (mc meteredConn) Read(b []byte) (int, error) {
+	n, err := mc.Conn.Read(b)
+	atomic.AddUint64(&mc.g.atomicBytesRead, uint64(n))
+	mc.g.readLimiter.wait(n, mc.g.threads.StopChan())
+	return n, err
+}
+
+// Write implements the io.Writer interface.
+func (mc meteredConn) Write(b []byte) (int, error) {
+	mc.g.writeLimiter.wait(len(b), mc.g.threads.StopChan())
+	n, err := mc.Conn.Write(b)
+	atomic.AddUint64(&mc.g.atomicBytesWritten, uint64(n))
+	return n, err
+}
+
+// keepAliveConn is a connection that supports TCP keepalives, such as a
+// *net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// enableKeepAlive turns on TCP keepalives with the given period for conn, if
+// conn supports them.
+func enableKeepAlive(conn net.Conn, period time.Duration) {
+	if kc, ok := conn.(keepAliveConn); ok {
+		kc.SetKeepAlive(true)
+		kc.SetKeepAlivePeriod(period)
+	}
+}
+
 // dial will dial the input address and return a connection. dial appropriately
 // handles things like clean shutdown, fast shutdown, and chooses the correct
 // communication protocol.
 func (g *Gateway) dial(addr modules.NetAddress) (net.Conn, error) {
-	dialer := &net.Dialer{
-		Cancel:  g.threads.StopChan(),
-		Timeout: dialTimeout,
+	g.mu.RLock()
+	var dialer Dialer = &net.Dialer{
+		Cancel:    g.threads.StopChan(),
+		Timeout:   dialTimeout,
+		KeepAlive: g.keepAlivePeriod,
+	}
+	if g.dialer != nil {
+		dialer = g.dialer
 	}
+	period := g.keepAlivePeriod
+	g.mu.RUnlock()
 	conn, err := dialer.Dial("tcp", string(addr))
 	if err != nil {
 		return nil, err
 	}
+	// The default Dialer has already enabled keepalives, but a custom Dialer
+	// may not have.
+	enableKeepAlive(conn, period)
 	conn.SetDeadline(time.Now().Add(connStdDeadline))
-	return conn, nil
+	return meteredConn{Conn: conn, g: g}, nil
+}
+
+// SetDialer sets the Dialer that the gateway uses for all outbound
+// connections. Passing nil restores the default, which dials peers directly
+// over TCP. Note that timeouts and shutdown cancellation are the
+// responsibility of a custom Dialer.
+//
+// DNS lookups and HTTP requests cannot be routed through a Dialer, so while a
+// custom Dialer is set, BootstrapFromDNS fails and the gateway does not ask
+// third party services for its external IP. The Dialer should be set right
+// after New, before the gateway is used.
+func (g *Gateway) SetDialer(d Dialer) {
+	g.mu.Lock()
+	g.dialer = d
+	g.mu.Unlock()
+}
+
+// SetKeepAlivePeriod sets the interval between TCP keepalive probes on peer
+// connections. The period only applies to connections made after it is set.
+func (g *Gateway) SetKeepAlivePeriod(d time.Duration) error {
+	if d <= 0 {
+		return errors.New("keepalive period must be positive")
+	}
+	g.mu.Lock()
+	g.keepAlivePeriod = d
+	g.mu.Unlock()
+	return nil
+}
+
+// isOurAddress returns true if addr refers to the gateway itself. This is the
+// case if addr is the gateway's own address, or if addr is the gateway's port
+// on a loopback address or on an IP assigned to one of the machine's network
+// interfaces.
+func (g *Gateway) isOurAddress(addr modules.NetAddress) bool {
+	if addr == g.myAddr {
+		return true
+	}
+	if addr.Port() != g.port {
+		return false
+	}
+	ip := net.ParseIP(addr.Host())
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	_, isInterfaceIP := g.interfaceIPs[ip.String()]
+	return isInterfaceIP
+}
+
+// managedRefreshInterfaceIPs updates the cached set of IPs that are assigned
+// to the machine's network interfaces. The set is cached because listing the
+// interfaces is a syscall, and isOurAddress is called for every address that
+// peers share.
+func (g *Gateway) managedRefreshInterfaceIPs() {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		g.log.Println("WARN: unable to list the addresses of the network interfaces:", err)
+		return
+	}
+	ips := make(map[string]struct{}, len(ifaceAddrs))
+	for _, ifaceAddr := range ifaceAddrs {
+		if ipnet, ok := ifaceAddr.(*net.IPNet); ok {
+			ips[ipnet.IP.String()] = struct{}{}
+		}
+	}
+	g.mu.Lock()
+	g.interfaceIPs = ips
+	g.mu.Unlock()
+}
+
+// threadedRefreshInterfaceIPs periodically refreshes the cached interface
+// IPs, as interfaces can gain and lose addresses while the gateway is running.
+func (g *Gateway) threadedRefreshInterfaceIPs() {
+	for {
+		select {
+		case <-g.threads.StopChan():
+			return
+		case <-time.After(interfaceRefreshInterval):
+		}
+
+		if g.threads.Add() != nil {
+			return
+		}
+		g.managedRefreshInterfaceIPs()
+		g.threads.Done()
+	}
 }
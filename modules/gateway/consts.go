@@ -11,6 +11,10 @@ const (
 	// was altered to include adiitional information transfer.
 	handshakeUpgradeVersion = "1.0.0"
 
+	// pingUpgradeVersion is the first version that answers the Ping RPC.
+	// Peers older than this close the stream instead of responding.
+	pingUpgradeVersion = "1.3.0"
+
 	// maxLocalOutbound is currently set to 3, meaning the gateway will not
 	// consider a local node to be an outbound peer if the gateway already has
 	// 3 outbound peers. Three is currently needed to handle situations where
@@ -20,6 +24,14 @@ const (
 	// connect to itself, this number can be reduced.
 	maxLocalOutboundPeers = 3
 
+	// maxConcurrentBroadcasts is the maximum number of peers that a single
+	// broadcast will call at once.
+	maxConcurrentBroadcasts = 16
+
+	// maxConcurrentSeedPings is the maximum number of DNS seed nodes that
+	// BootstrapFromDNS will ping at once.
+	maxConcurrentSeedPings = 16
+
 	// minAcceptableVersion is the version below which the gateway will refuse to
 	// connect to peers and reject connection attempts.
 	//
@@ -29,6 +41,11 @@ const (
 
 	// saveFrequency defines how often the gateway saves its persistence.
 	saveFrequency = time.Minute * 2
+
+	// subscriberBufferSize is the number of payloads that are buffered for
+	// each subscriber. Payloads that arrive while a subscriber's buffer is
+	// full are dropped.
+	subscriberBufferSize = 32
 )
 
 var (
@@ -57,6 +74,24 @@ var (
 		Testing:  uint64(3),
 	}).(uint64)
 
+	// maxNodeListLen defines the maximum number of nodes that the gateway will
+	// keep in its node list. Once the node list is full, the least recently
+	// seen node is evicted whenever a new node is added, preferring nodes that
+	// have not been verified.
+	maxNodeListLen = build.Select(build.Var{
+		Standard: int(1000),
+		Dev:      int(500),
+		Testing:  int(500),
+	}).(int)
+
+	// nodeExpiryAge defines how long a node can go without being seen before
+	// it is purged from the node list.
+	nodeExpiryAge = build.Select(build.Var{
+		Standard: 30 * 24 * time.Hour,
+		Dev:      1 * time.Hour,
+		Testing:  1 * time.Minute,
+	}).(time.Duration)
+
 	// nodePurgeDelay defines the amount of time that is waited between each
 	// iteration of the node purge loop.
 	nodePurgeDelay = build.Select(build.Var{
@@ -114,6 +149,15 @@ var (
 		Testing:  100 * time.Millisecond,
 	}).(time.Duration)
 
+	// acceptRetryDelay is the amount of time that permanentListen waits before
+	// calling Accept again after a temporary error, such as running out of
+	// file descriptors.
+	acceptRetryDelay = build.Select(build.Var{
+		Standard: time.Second,
+		Dev:      time.Second,
+		Testing:  10 * time.Millisecond,
+	}).(time.Duration)
+
 	// acquiringPeersDelay defines the amount of time that is waited between
 	// iterations of the peer acquisition loop if the gateway is actively
 	// forming new connections with peers.
@@ -131,6 +175,14 @@ var (
 		Testing:  10,
 	}).(int)
 
+	// interfaceRefreshInterval defines how often the gateway refreshes its
+	// list of the IPs assigned to the machine's network interfaces.
+	interfaceRefreshInterval = build.Select(build.Var{
+		Standard: 10 * time.Minute,
+		Dev:      1 * time.Minute,
+		Testing:  1 * time.Second,
+	}).(time.Duration)
+
 	// maxConcurrentOutboundPeerRequests defines the maximum number of peer
 	// connections that the gateway will try to form concurrently.
 	maxConcurrentOutboundPeerRequests = build.Select(build.Var{
@@ -139,6 +191,24 @@ var (
 		Testing:  2,
 	}).(int)
 
+	// maxInboundPeersPerHost defines the maximum number of inbound peers that
+	// the gateway will accept from a single non-local host. Without this
+	// limit a single machine could take up every inbound slot by connecting
+	// with many different dialback ports.
+	maxInboundPeersPerHost = build.Select(build.Var{
+		Standard: 8,
+		Dev:      8,
+		Testing:  2,
+	}).(int)
+
+	// maxPeerPingFailures is the number of consecutive health check pings a
+	// peer can fail before the gateway disconnects from it.
+	maxPeerPingFailures = build.Select(build.Var{
+		Standard: 3,
+		Dev:      3,
+		Testing:  2,
+	}).(int)
+
 	// noNodesDelay defines the amount of time that is waited between
 	// iterations of the peer acquisition loop if the gateway does not have any
 	// nodes in the nodelist.
@@ -148,6 +218,14 @@ var (
 		Testing:  3 * time.Second,
 	}).(time.Duration)
 
+	// peerHealthCheckInterval defines the amount of time that is waited
+	// between pinging every peer to check that it is still responsive.
+	peerHealthCheckInterval = build.Select(build.Var{
+		Standard: 5 * time.Minute,
+		Dev:      1 * time.Minute,
+		Testing:  500 * time.Millisecond,
+	}).(time.Duration)
+
 	// unwawntedLocalPeerDelay defines the amount of time that is waited
 	// between iterations of the permanentPeerManager if the gateway has at
 	// least a few outbound peers, but is not well connected, and the recently
@@ -179,6 +257,14 @@ var (
 )
 
 var (
+	// broadcastRetryDelay defines the amount of time that is waited before
+	// retrying a broadcast to a peer that failed to receive it.
+	broadcastRetryDelay = build.Select(build.Var{
+		Standard: 10 * time.Second,
+		Dev:      10 * time.Second,
+		Testing:  500 * time.Millisecond,
+	}).(time.Duration)
+
 	// connStdDeadline defines the standard deadline that should be used for
 	// all temporary connections to the gateway.
 	connStdDeadline = build.Select(build.Var{
@@ -194,6 +280,24 @@ var (
 		Testing:  500 * time.Millisecond,
 	}).(time.Duration)
 
+	// keepAlivePeriod is the default interval between TCP keepalive probes on
+	// peer connections. It can be changed with SetKeepAlivePeriod. Keepalives
+	// let the OS tear down connections to peers that have vanished without
+	// closing them, e.g. after a crash or an expired NAT mapping.
+	keepAlivePeriod = build.Select(build.Var{
+		Standard: 30 * time.Second,
+		Dev:      30 * time.Second,
+		Testing:  5 * time.Second,
+	}).(time.Duration)
+
+	// pingTimeout defines the amount of time that a peer has to respond to
+	// the Ping RPC.
+	pingTimeout = build.Select(build.Var{
+		Standard: 30 * time.Second,
+		Dev:      10 * time.Second,
+		Testing:  1 * time.Second,
+	}).(time.Duration)
+
 	// rpcStdDeadline defines the standard deadline that should be used for all
 	// incoming RPC calls.
 	rpcStdDeadline = build.Select(build.Var{
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+var errNoDNSSeedNodes = errors.New("no reachable nodes were found through the DNS seeds")
+
+// dnsSeedCandidates resolves each seed hostname and returns the distinct,
+// valid addresses formed by combining the resolved IPs with port. Seeds that
+// fail to resolve are skipped.
+func (g *Gateway) dnsSeedCandidates(seeds []string, port string) []modules.NetAddress {
+	seen := make(map[modules.NetAddress]struct{})
+	var candidates []modules.NetAddress
+	for _, seed := range seeds {
+		ips, err := g.lookupHost(seed)
+		if err != nil {
+			g.log.Debugf("WARN: failed to resolve DNS seed %q: %v", seed, err)
+			continue
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				continue
+			}
+			addr := canonicalAddr(modules.NetAddress(net.JoinHostPort(ip, port)))
+			if _, exists := seen[addr]; exists || addr.IsValid() != nil {
+				continue
+			}
+			seen[addr] = struct{}{}
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+// BootstrapFromDNS resolves the seed hostnames and adds every resolved
+// address, on the given port, that a gateway can be reached at to the node
+// list. Unlike modules.BootstrapPeers, the set of nodes behind a DNS seed can
+// change without a new release. An error is returned if no reachable nodes
+// were found. DNS seeds are resolved directly, so BootstrapFromDNS returns an
+// error without resolving anything if a custom Dialer is set.
+func (g *Gateway) BootstrapFromDNS(seeds []string, port string) error {
+	if err := g.threads.Add(); err != nil {
+		return err
+	}
+	defer g.threads.Done()
+
+	g.mu.RLock()
+	customDialer := g.dialer != nil
+	g.mu.RUnlock()
+	if customDialer {
+		return errCustomDialer
+	}
+
+	candidates := g.dnsSeedCandidates(seeds, port)
+
+	// Ping the candidates in parallel, adding the reachable ones. A seed can
+	// return any number of addresses, so the number of pings in flight is
+	// limited.
+	var found bool
+	var wg sync.WaitGroup
+	limiterChan := make(chan struct{}, maxConcurrentSeedPings)
+	for _, addr := range candidates {
+		wg.Add(1)
+		limiterChan <- struct{}{}
+		go func(addr modules.NetAddress) {
+			defer func() {
+				<-limiterChan
+				wg.Done()
+			}()
+			if err := g.pingNode(addr); err != nil {
+				g.log.Debugf("INFO: DNS seed node %v is unreachable: %v", addr, err)
+				return
+			}
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			err := g.addNode(addr)
+			if err == nil || err == errNodeExists {
+				found = true
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if !found {
+		return errNoDNSSeedNodes
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// TestBootstrapFromDNS checks that BootstrapFromDNS adds the reachable
+// addresses returned by the DNS seeds to the node list, and skips unreachable
+// addresses and seeds that fail to resolve.
+func TestBootstrapFromDNS(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	// g2 listens on 127.0.0.1 only, so nothing is reachable at 127.0.0.2.
+	g1.lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "seed1.example.com":
+			return []string{"127.0.0.1", "127.0.0.2"}, nil
+		case "seed2.example.com":
+			return []string{"127.0.0.1", "not an ip"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	port := g2.Address().Port()
+	seeds := []string{"seed1.example.com", "seed2.example.com", "bad.example.com"}
+	if err := g1.BootstrapFromDNS(seeds, port); err != nil {
+		t.Fatal(err)
+	}
+
+	reachable := modules.NetAddress(net.JoinHostPort("127.0.0.1", port))
+	unreachable := modules.NetAddress(net.JoinHostPort("127.0.0.2", port))
+	g1.mu.RLock()
+	_, added := g1.nodes[reachable]
+	_, addedUnreachable := g1.nodes[unreachable]
+	g1.mu.RUnlock()
+	if !added {
+		t.Error("reachable DNS seed node was not added")
+	}
+	if addedUnreachable {
+		t.Error("unreachable DNS seed node was added")
+	}
+
+	// A seed with no reachable nodes should result in an error.
+	if err := g1.BootstrapFromDNS([]string{"bad.example.com"}, port); err != errNoDNSSeedNodes {
+		t.Fatalf("expected %v, got %v", errNoDNSSeedNodes, err)
+	}
+}
+
+// TestBootstrapFromDNSCustomDialer checks that BootstrapFromDNS does not
+// resolve DNS seeds while a custom Dialer is set, since the lookups would not
+// go through the Dialer.
+func TestBootstrapFromDNSCustomDialer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	var lookups int
+	g.lookupHost = func(host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, nil
+	}
+	g.SetDialer(new(recordingDialer))
+	if err := g.BootstrapFromDNS([]string{"seed.example.com"}, "9981"); err != errCustomDialer {
+		t.Fatalf("expected %v, got %v", errCustomDialer, err)
+	}
+	if lookups != 0 {
+		t.Fatal("DNS seed was resolved despite the custom dialer")
+	}
+}
+
+// TestBootstrapFromDNSConcurrency checks that BootstrapFromDNS pings every
+// address returned by the DNS seeds, but no more than maxConcurrentSeedPings
+// at once.
+func TestBootstrapFromDNSConcurrency(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	// Listen on every loopback address, holding each connection open for a
+	// moment so that concurrent pings overlap.
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var mu sync.Mutex
+	var active, maxActive, total int
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			active++
+			total++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				active--
+				mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+
+	numAddrs := 3 * maxConcurrentSeedPings
+	g.lookupHost = func(host string) ([]string, error) {
+		var ips []string
+		for i := 1; i <= numAddrs; i++ {
+			ips = append(ips, "127.0.0."+strconv.Itoa(i))
+		}
+		return ips, nil
+	}
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// None of the listeners complete the handshake, so no nodes are found.
+	if err := g.BootstrapFromDNS([]string{"seed.example.com"}, port); err != errNoDNSSeedNodes {
+		t.Fatalf("expected %v, got %v", errNoDNSSeedNodes, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if total != numAddrs {
+		t.Errorf("expected %v pings, got %v", numAddrs, total)
+	}
+	if maxActive > maxConcurrentSeedPings {
+		t.Errorf("expected at most %v concurrent pings, got %v", maxConcurrentSeedPings, maxActive)
+	}
+}
@@ -92,12 +92,6 @@ import (
 // is no public key exhcange, so communications cannot be effectively encrypted
 // or authenticated. The nodes must have some way to share keys.
 //
-// TODO: Gateway hostname discovery currently has significant centralization,
-// namely the fallback is a single third-party website that can easily form any
-// response it wants. Instead, multiple TLS-protected third party websites
-// should be used, and the plurality answer should be accepted as the true
-// hostname.
-//
 // TODO: The gateway currently does hostname discovery in a non-blocking way,
 // which means that the first few peers that it connects to may not get the
 // correct hostname. This means that you may give the remote peer the wrong
@@ -136,12 +130,16 @@ import (
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/NebulousLabs/Sia/crypto"
 	"github.com/NebulousLabs/Sia/modules"
 	"github.com/NebulousLabs/Sia/persist"
 	siasync "github.com/NebulousLabs/Sia/sync"
@@ -154,15 +152,44 @@ var (
 
 // Gateway implements the modules.Gateway interface.
 type Gateway struct {
+	// Network metrics - atomic variables need to be placed at the top to
+	// preserve compatibility with 32bit systems. These values are not
+	// persistent.
+	//
+	// atomicActiveRPCs is the number of incoming RPCs that are currently being
+	// handled.
+	//
+	// atomicUnknownRPCCalls is the number of incoming calls to RPCs that have
+	// no handler.
+	atomicActiveRPCs      uint64
+	atomicBytesRead       uint64
+	atomicBytesWritten    uint64
+	atomicUnknownRPCCalls uint64
+
 	listener net.Listener
 	myAddr   modules.NetAddress
 	port     string
 
+	// interfaceIPs is the set of IPs assigned to the machine's network
+	// interfaces, which are aliases of myAddr. It is refreshed periodically
+	// and whenever myAddr changes.
+	interfaceIPs map[string]struct{}
+
 	// handlers are the RPCs that the Gateway can handle.
 	//
 	// initRPCs are the RPCs that the Gateway calls upon connecting to a peer.
-	handlers map[rpcID]modules.RPCFunc
-	initRPCs map[string]modules.RPCFunc
+	//
+	// rpcCalls counts the incoming calls to each RPC. It is protected by
+	// rpcCallsMu rather than mu, so that counting a call does not require
+	// exclusive access to the rest of the gateway.
+	handlers   map[rpcID]modules.RPCFunc
+	initRPCs   map[string]modules.RPCFunc
+	rpcCalls   map[rpcID]uint64
+	rpcCallsMu sync.Mutex
+
+	// subscriptions are the RPCs whose payloads are delivered to channels
+	// returned by Subscribe.
+	subscriptions map[rpcID]*subscription
 
 	// nodes is the set of all known nodes (i.e. potential peers).
 	//
@@ -179,14 +206,58 @@ type Gateway struct {
 	// and would block any threads.Flush() calls. So a second threadgroup is
 	// added which handles clean-shutdown for the peers, without blocking
 	// threads.Flush() calls.
-	nodes  map[modules.NetAddress]struct{}
+	nodes  map[modules.NetAddress]*node
 	peers  map[modules.NetAddress]*peer
 	peerTG siasync.ThreadGroup
 
-	// Utilities.
+	// bannedHosts is the set of hosts that the gateway refuses to communicate
+	// with.
+	//
+	// peerFilter, if set, rejects addresses for which it returns false.
+	bannedHosts map[string]struct{}
+	peerFilter  func(modules.NetAddress) bool
+
+	// connectHooks and disconnectHooks are called when a peer is added to and
+	// removed from the peer list.
+	connectHooks    []func(modules.NetAddress)
+	disconnectHooks []func(modules.NetAddress)
+
+	// readLimiter and writeLimiter limit the combined download and upload
+	// speed of all peer connections.
+	readLimiter  rateLimiter
+	writeLimiter rateLimiter
+
+	// secretKey is the gateway's identity key, which peers can ask it to
+	// prove ownership of with the Identify RPC.
+	//
+	// pinnedKeys are the identity keys that outbound peers at the given
+	// addresses must prove ownership of. The proof is not bound to the
+	// connection, so pinning does not authenticate the peer's traffic.
+	secretKey  crypto.SecretKey
+	pinnedKeys map[modules.NetAddress]crypto.PublicKey
+
+	// dialer, if set, is used in place of a direct TCP dial for all outbound
+	// connections, e.g. to route traffic through a SOCKS5 proxy.
+	dialer Dialer
+
+	// keepAlivePeriod is the interval between TCP keepalive probes on peer
+	// connections.
+	keepAlivePeriod time.Duration
+
+	// privateMode, if set, stops the gateway from sharing its node list and
+	// from accepting inbound connections.
+	privateMode bool
+
+	// lookupHost resolves DNS seed hostnames. It is net.LookupHost except in
+	// tests.
+	lookupHost func(string) ([]string, error)
+
+	// Utilities. persistMu serializes writes of the persist file, and is
+	// always acquired before mu.
 	log        *persist.Logger
 	mu         sync.RWMutex
 	persistDir string
+	persistMu  sync.Mutex
 	threads    siasync.ThreadGroup
 }
 
@@ -209,14 +280,81 @@ func (g *Gateway) Address() modules.NetAddress {
 	return g.myAddr
 }
 
+// managedRPCCalls returns a copy of the number of calls to each registered
+// RPC, keyed by RPC name.
+func (g *Gateway) managedRPCCalls() map[string]uint64 {
+	g.rpcCallsMu.Lock()
+	defer g.rpcCallsMu.Unlock()
+	rpcCalls := make(map[string]uint64, len(g.rpcCalls))
+	for id, n := range g.rpcCalls {
+		rpcCalls[strings.TrimSpace(id.String())] = n
+	}
+	return rpcCalls
+}
+
+// NetworkMetrics returns a snapshot of the gateway's network activity since it
+// was started.
+func (g *Gateway) NetworkMetrics() modules.GatewayNetworkMetrics {
+	rpcCalls := g.managedRPCCalls()
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return modules.GatewayNetworkMetrics{
+		ActiveRPCs:      atomic.LoadUint64(&g.atomicActiveRPCs),
+		BytesRead:       atomic.LoadUint64(&g.atomicBytesRead),
+		BytesWritten:    atomic.LoadUint64(&g.atomicBytesWritten),
+		RPCCalls:        rpcCalls,
+		UnknownRPCCalls: atomic.LoadUint64(&g.atomicUnknownRPCCalls),
+		Nodes:           len(g.nodes),
+		Peers:           len(g.peers),
+	}
+}
+
+// RegisterMetrics publishes the gateway's network metrics in m, using the same
+// keys as the JSON encoding of modules.GatewayNetworkMetrics. The values are
+// only computed when m is read, so registering adds no overhead to the
+// gateway's connections and RPCs. Publishing m with expvar.Publish makes the
+// metrics available to scrapers at /debug/vars.
+func (g *Gateway) RegisterMetrics(m *expvar.Map) {
+	loadUint64 := func(addr *uint64) expvar.Func {
+		return func() interface{} { return atomic.LoadUint64(addr) }
+	}
+	m.Set("activerpcs", loadUint64(&g.atomicActiveRPCs))
+	m.Set("bytesread", loadUint64(&g.atomicBytesRead))
+	m.Set("byteswritten", loadUint64(&g.atomicBytesWritten))
+	m.Set("unknownrpccalls", loadUint64(&g.atomicUnknownRPCCalls))
+	m.Set("rpccalls", expvar.Func(func() interface{} {
+		return g.managedRPCCalls()
+	}))
+	m.Set("nodes", expvar.Func(func() interface{} {
+		g.mu.RLock()
+		defer g.mu.RUnlock()
+		return len(g.nodes)
+	}))
+	m.Set("peers", expvar.Func(func() interface{} {
+		g.mu.RLock()
+		defer g.mu.RUnlock()
+		return len(g.peers)
+	}))
+}
+
+// SetPrivateMode enables or disables private mode. A gateway in private mode
+// still connects to peers and requests nodes from them, but refuses to share
+// its own node list and rejects inbound connections. Because peers only add a
+// node to their node list after dialing it back, a private gateway is not
+// advertised to the rest of the network.
+func (g *Gateway) SetPrivateMode(private bool) {
+	g.mu.Lock()
+	g.privateMode = private
+	g.mu.Unlock()
+}
+
 // Close saves the state of the Gateway and stops its listener process.
 func (g *Gateway) Close() error {
 	if err := g.threads.Stop(); err != nil {
 		return err
 	}
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	return g.saveSync()
+	return g.managedSaveSync()
 }
 
 // New returns an initialized Gateway.
@@ -230,9 +368,18 @@ func New(addr string, bootstrap bool, persistDir string) (*Gateway, error) {
 	g := &Gateway{
 		handlers: make(map[rpcID]modules.RPCFunc),
 		initRPCs: make(map[string]modules.RPCFunc),
+		rpcCalls: make(map[rpcID]uint64),
+
+		subscriptions: make(map[rpcID]*subscription),
 
 		peers: make(map[modules.NetAddress]*peer),
-		nodes: make(map[modules.NetAddress]struct{}),
+		nodes: make(map[modules.NetAddress]*node),
+
+		bannedHosts: make(map[string]struct{}),
+		pinnedKeys:  make(map[modules.NetAddress]crypto.PublicKey),
+
+		keepAlivePeriod: keepAlivePeriod,
+		lookupHost:      net.LookupHost,
 
 		persistDir: persistDir,
 	}
@@ -263,13 +410,30 @@ func New(addr string, bootstrap bool, persistDir string) (*Gateway, error) {
 
 	// Register RPCs.
 	g.RegisterRPC("ShareNodes", g.shareNodes)
+	g.RegisterRPC("Ping", g.pong)
+	g.RegisterRPC("Identify", g.identify)
+	g.RegisterRPC("DialBack", g.dialBack)
 	g.RegisterConnectCall("ShareNodes", g.requestNodes)
 	// Establish the de-registration of the RPCs.
 	g.threads.OnStop(func() {
 		g.UnregisterRPC("ShareNodes")
+		g.UnregisterRPC("Ping")
+		g.UnregisterRPC("Identify")
+		g.UnregisterRPC("DialBack")
 		g.UnregisterConnectCall("ShareNodes")
 	})
 
+	// Load the identity key, generating a new one if this is the first time
+	// the gateway has been started.
+	if err := g.loadIdentity(); err != nil {
+		return nil, err
+	}
+
+	// Learn the IPs of the machine's network interfaces, so that the gateway
+	// can recognize its own address, and keep them up to date.
+	g.managedRefreshInterfaceIPs()
+	go g.threadedRefreshInterfaceIPs()
+
 	// Load the old node list. If it doesn't exist, no problem, but if it does,
 	// we want to know about any errors preventing us from loading it.
 	if loadErr := g.load(); loadErr != nil && !os.IsNotExist(loadErr) {
@@ -279,9 +443,7 @@ func New(addr string, bootstrap bool, persistDir string) (*Gateway, error) {
 	go g.threadedSaveLoop()
 	// Make sure that the gateway saves after shutdown.
 	g.threads.AfterStop(func() {
-		g.mu.Lock()
-		err = g.saveSync()
-		g.mu.Unlock()
+		err = g.managedSaveSync()
 		if err != nil {
 			g.log.Println("ERROR: Unable to save gateway:", err)
 		}
@@ -344,6 +506,14 @@ func New(addr string, bootstrap bool, persistDir string) (*Gateway, error) {
 	})
 	go g.permanentNodePurger(nodePurgerClosedChan)
 
+	// Spawn the peer health checker and provide tools for ensuring clean
+	// shutdown.
+	peerHealthCheckerClosedChan := make(chan struct{})
+	g.threads.OnStop(func() {
+		<-peerHealthCheckerClosedChan
+	})
+	go g.permanentPeerHealthChecker(peerHealthCheckerClosedChan)
+
 	// Spawn threads to take care of port forwarding and hostname discovery.
 	go g.threadedForwardPort(g.port)
 	go g.threadedLearnHostname()
@@ -1,6 +1,8 @@
 package gateway
 
 import (
+	"encoding/json"
+	"expvar"
 	"io/ioutil"
 	"net"
 	"os"
@@ -8,6 +10,7 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/NebulousLabs/Sia/build"
 	"github.com/NebulousLabs/Sia/modules"
@@ -89,6 +92,11 @@ func TestAddress(t *testing.T) {
 	if !ip.IsLoopback() {
 		t.Fatal("expected a loopback address")
 	}
+	// The gateway was created with port 0, so the address should report the
+	// port chosen by the OS.
+	if port := g.Address().Port(); port == "" || port == "0" {
+		t.Fatal("expected a non-zero port, got", port)
+	}
 }
 
 // TestPeers checks that two gateways are able to connect to each other.
@@ -209,3 +217,156 @@ func TestParallelClose(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// TestCloseWaitsForHandlers checks that Close blocks until RPC handlers that
+// are already running have returned.
+func TestCloseWaitsForHandlers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+
+	err := g1.Connect(g2.Address())
+	if err != nil {
+		t.Fatal("failed to connect:", err)
+	}
+
+	startedChan := make(chan struct{})
+	var handlerDone bool
+	var mu sync.Mutex
+	g2.RegisterRPC("Slow", func(conn modules.PeerConn) error {
+		close(startedChan)
+		time.Sleep(500 * time.Millisecond)
+		mu.Lock()
+		handlerDone = true
+		mu.Unlock()
+		return nil
+	})
+	go g1.RPC(g2.Address(), "Slow", func(modules.PeerConn) error { return nil })
+
+	<-startedChan
+	if err := g2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !handlerDone {
+		t.Fatal("Close returned before the in-flight handler finished")
+	}
+}
+
+// TestNetworkMetrics checks that the gateway counts the traffic and RPC calls
+// that pass through it.
+func TestNetworkMetrics(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := g1.Ping(g2.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m1, m2 := g1.NetworkMetrics(), g2.NetworkMetrics()
+	if m1.BytesRead == 0 || m1.BytesWritten == 0 {
+		t.Error("outbound connection traffic was not counted:", m1)
+	}
+	if m2.BytesRead == 0 || m2.BytesWritten == 0 {
+		t.Error("inbound connection traffic was not counted:", m2)
+	}
+	if m2.RPCCalls["Ping"] != 3 {
+		t.Errorf("expected 3 Ping calls, got %v", m2.RPCCalls["Ping"])
+	}
+	if m1.Peers != 1 || m2.Peers != 1 {
+		t.Errorf("expected 1 peer each, got %v and %v", m1.Peers, m2.Peers)
+	}
+}
+
+// TestRegisterMetrics checks that the metrics published by RegisterMetrics
+// match the gateway's NetworkMetrics after it has handled some traffic.
+func TestRegisterMetrics(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	m := new(expvar.Map).Init()
+	g2.RegisterMetrics(m)
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := g1.Ping(g2.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Background RPCs and dial-backs may add traffic and nodes while the
+	// metrics are being scraped, so those values are checked against snapshots
+	// taken before and after the scrape.
+	before := g2.NetworkMetrics()
+	var scraped modules.GatewayNetworkMetrics
+	if err := json.Unmarshal([]byte(m.String()), &scraped); err != nil {
+		t.Fatal(err)
+	}
+	after := g2.NetworkMetrics()
+
+	if scraped.BytesRead == 0 || scraped.BytesRead < before.BytesRead || scraped.BytesRead > after.BytesRead {
+		t.Errorf("scraped bytesread %v, expected between %v and %v", scraped.BytesRead, before.BytesRead, after.BytesRead)
+	}
+	if scraped.BytesWritten == 0 || scraped.BytesWritten < before.BytesWritten || scraped.BytesWritten > after.BytesWritten {
+		t.Errorf("scraped byteswritten %v, expected between %v and %v", scraped.BytesWritten, before.BytesWritten, after.BytesWritten)
+	}
+	if scraped.RPCCalls["Ping"] != 3 || scraped.RPCCalls["Ping"] != after.RPCCalls["Ping"] {
+		t.Errorf("scraped %v Ping calls, expected 3", scraped.RPCCalls["Ping"])
+	}
+	if scraped.UnknownRPCCalls != after.UnknownRPCCalls {
+		t.Errorf("scraped %v unknown RPC calls, expected %v", scraped.UnknownRPCCalls, after.UnknownRPCCalls)
+	}
+	if scraped.Peers != 1 || scraped.Peers != after.Peers {
+		t.Errorf("scraped %v peers, expected 1", scraped.Peers)
+	}
+	if scraped.Nodes < before.Nodes || scraped.Nodes > after.Nodes {
+		t.Errorf("scraped %v nodes, expected between %v and %v", scraped.Nodes, before.Nodes, after.Nodes)
+	}
+}
+
+// TestIPv6 checks that a gateway can listen on an IPv6 address and accept
+// peers over it.
+func TestIPv6(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1, err := New("[::1]:0", false, build.TempDir("gateway", t.Name()+"1"))
+	if err != nil {
+		t.Skip("IPv6 loopback is unavailable:", err)
+	}
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	if err := g2.Connect(g1.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g2.Ping(g1.Address()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,176 @@
+package gateway
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/persist"
+	"github.com/NebulousLabs/fastrand"
+	"github.com/NebulousLabs/muxado"
+)
+
+const (
+	// identityFile is the name of the file that contains the gateway's
+	// identity key.
+	identityFile = "identity.json"
+
+	// maxIdentityProofLen is the maximum encoded size of an identityProof.
+	maxIdentityProofLen = 256
+)
+
+// identityMetadata contains the header and version strings that identify the
+// identity file.
+var identityMetadata = persist.Metadata{
+	Header:  "Sia Gateway Identity",
+	Version: "1.0",
+}
+
+var errIdentityMismatch = errors.New("peer could not prove ownership of its pinned identity key")
+
+// identityProof is the response to the Identify RPC. It proves that the
+// sender holds, or can get a signature from the holder of, the secret key for
+// PublicKey.
+type identityProof struct {
+	PublicKey crypto.PublicKey
+	Signature crypto.Signature
+}
+
+// identityChallengeHash returns the hash that a gateway signs to answer an
+// Identify challenge.
+//
+// The hash is not bound to the connection that the challenge arrived on, so a
+// node in the middle of a connection can forward the challenge to the real key
+// holder and relay its signature back. Identify therefore only shows that the
+// key holder is online and reachable by whoever answered; it does not
+// authenticate the connection. Binding the proof to the connection would
+// require the peers to agree on a session key and authenticate all further
+// traffic with it, which the gateway protocol does not do.
+func identityChallengeHash(challenge [crypto.EntropySize]byte, pk crypto.PublicKey) crypto.Hash {
+	return crypto.HashAll("Identify", challenge, pk)
+}
+
+// loadIdentity loads the gateway's identity key from disk. If there is no
+// identity file, a new key is generated and saved.
+func (g *Gateway) loadIdentity() error {
+	filename := filepath.Join(g.persistDir, identityFile)
+	err := persist.LoadJSON(identityMetadata, &g.secretKey, filename)
+	if os.IsNotExist(err) {
+		g.secretKey, _ = crypto.GenerateKeyPair()
+		return persist.SaveJSON(identityMetadata, g.secretKey, filename)
+	}
+	return err
+}
+
+// identify is the receiving end of the Identify RPC. It signs a challenge
+// chosen by the caller, proving that the gateway holds its identity key.
+func (g *Gateway) identify(conn modules.PeerConn) error {
+	conn.SetDeadline(time.Now().Add(connStdDeadline))
+
+	var challenge [crypto.EntropySize]byte
+	if err := encoding.ReadObject(conn, &challenge, crypto.EntropySize); err != nil {
+		return err
+	}
+	pk := g.secretKey.PublicKey()
+	return encoding.WriteObject(conn, identityProof{
+		PublicKey: pk,
+		Signature: crypto.SignHash(identityChallengeHash(challenge, pk), g.secretKey),
+	})
+}
+
+// requestIdentity is the calling end of the Identify RPC. It returns the
+// peer's identity key if the peer proves that it holds the key.
+func requestIdentity(conn modules.PeerConn) (crypto.PublicKey, error) {
+	conn.SetDeadline(time.Now().Add(connStdDeadline))
+
+	var challenge [crypto.EntropySize]byte
+	fastrand.Read(challenge[:])
+	if err := encoding.WriteObject(conn, challenge); err != nil {
+		return crypto.PublicKey{}, err
+	}
+	var proof identityProof
+	if err := encoding.ReadObject(conn, &proof, maxIdentityProofLen); err != nil {
+		return crypto.PublicKey{}, err
+	}
+	if err := crypto.VerifyHash(identityChallengeHash(challenge, proof.PublicKey), proof.PublicKey, proof.Signature); err != nil {
+		return crypto.PublicKey{}, err
+	}
+	return proof.PublicKey, nil
+}
+
+// managedIdentify calls the Identify RPC on a connected peer and returns the
+// peer's identity key if the peer proves that it holds the key.
+func (g *Gateway) managedIdentify(addr modules.NetAddress) (pk crypto.PublicKey, err error) {
+	err = g.managedRPC(addr, "Identify", func(conn modules.PeerConn) (err error) {
+		pk, err = requestIdentity(conn)
+		return err
+	})
+	return pk, err
+}
+
+// managedVerifyPinnedIdentity checks that the node at addr can prove
+// ownership of the identity key pinned for its address. It is called on the
+// session of an outbound connection before the node is added as a peer, so
+// that a node which fails the check is never added to the peer list or the
+// node list. Nodes without a pinned key are not checked.
+func (g *Gateway) managedVerifyPinnedIdentity(sess muxado.Session, addr modules.NetAddress) error {
+	g.mu.RLock()
+	pinned, ok := g.pinnedKeys[addr]
+	g.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	var pk crypto.PublicKey
+	p := &peer{Peer: modules.Peer{NetAddress: addr}, sess: sess}
+	err := callRPC(p, "Identify", func(conn modules.PeerConn) (err error) {
+		pk, err = requestIdentity(conn)
+		return err
+	})
+	if err != nil || pk != pinned {
+		return errIdentityMismatch
+	}
+	return nil
+}
+
+// PublicKey returns the gateway's identity key. The key is persisted, so it
+// identifies the gateway across restarts and changes of address.
+func (g *Gateway) PublicKey() crypto.PublicKey {
+	return g.secretKey.PublicKey()
+}
+
+// PeerIdentity asks a connected peer to prove ownership of its identity key,
+// and returns the key. Peers that predate the Identify RPC will close the
+// stream without responding, resulting in an error. A peer that relays the
+// Identify RPC to another node will return that node's key, so the key only
+// identifies the peer if the connection to it is trusted.
+func (g *Gateway) PeerIdentity(addr modules.NetAddress) (crypto.PublicKey, error) {
+	if err := g.threads.Add(); err != nil {
+		return crypto.PublicKey{}, err
+	}
+	defer g.threads.Done()
+	return g.managedIdentify(addr)
+}
+
+// PinIdentity pins the identity key of the node at addr. Future outbound
+// connections to addr are dropped unless the peer proves ownership of pk.
+// Pins are not persisted across restarts.
+//
+// Pinning protects against connecting to a different node at addr, e.g. after
+// the address has been reassigned, but not against a man-in-the-middle: a
+// node that relays traffic to the real key holder passes the check. See
+// identityChallengeHash.
+func (g *Gateway) PinIdentity(addr modules.NetAddress, pk crypto.PublicKey) error {
+	if err := g.threads.Add(); err != nil {
+		return err
+	}
+	defer g.threads.Done()
+
+	g.mu.Lock()
+	g.pinnedKeys[canonicalAddr(addr)] = pk
+	g.mu.Unlock()
+	return nil
+}
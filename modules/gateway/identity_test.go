@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// TestPeerIdentity checks that a gateway can learn a peer's identity key, and
+// that the key persists across restarts.
+func TestPeerIdentity(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := g1.PeerIdentity(g2.Address())
+	if err != nil {
+		t.Fatal(err)
+	} else if pk != g2.PublicKey() {
+		t.Fatal("PeerIdentity returned the wrong key")
+	}
+
+	// Restart g2; its identity key should not change.
+	if err := g2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	g2, err = New("localhost:0", false, g2.persistDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g2.Close()
+	if g2.PublicKey() != pk {
+		t.Fatal("identity key changed after restart")
+	}
+}
+
+// TestPinIdentity checks that the gateway drops outbound peers that cannot
+// prove ownership of their pinned identity key, before they are added to the
+// peer list or the node list.
+func TestPinIdentity(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	var connects uint64
+	g1.OnPeerConnect(func(modules.NetAddress) {
+		atomic.AddUint64(&connects, 1)
+	})
+
+	// Pin a key that g2 does not hold.
+	_, wrongKey := crypto.GenerateKeyPair()
+	if err := g1.PinIdentity(g2.Address(), wrongKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Connect(g2.Address()); err != errIdentityMismatch {
+		t.Fatalf("expected %v, got %v", errIdentityMismatch, err)
+	}
+	if len(g1.Peers()) != 0 {
+		t.Fatal("gateway kept a peer that failed identity verification")
+	}
+	if _, err := g1.NodeLastSeen(g2.Address()); err == nil {
+		t.Fatal("gateway added a node that failed identity verification")
+	}
+	if n := atomic.LoadUint64(&connects); n != 0 {
+		t.Fatalf("connect hook was called %v times for a peer that failed identity verification", n)
+	}
+
+	// Pin the correct key.
+	if err := g1.PinIdentity(g2.Address(), g2.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+}
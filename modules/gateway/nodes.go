@@ -11,15 +11,55 @@ import (
 )
 
 var (
-	errNodeExists = errors.New("node already added")
-	errNoNodes    = errors.New("no nodes in the node list")
-	errOurAddress = errors.New("can't add our own address")
+	errNodeExists   = errors.New("node already added")
+	errNodeListFull = errors.New("node list is full")
+	errNoNodes      = errors.New("no nodes in the node list")
+	errOurAddress   = errors.New("address belongs to this gateway")
+	errPrivateMode  = errors.New("gateway is in private mode")
 )
 
-// addNode adds an address to the set of nodes on the network.
+// node is an entry in the gateway's node list.
+type node struct {
+	// lastSeen is the most recent time that the node was added to the node
+	// list or was confirmed to be reachable. Nodes that have not been seen
+	// for nodeExpiryAge are purged.
+	//
+	// verified is set once the node has been confirmed to be reachable, i.e.
+	// it has been seen again after it was added.
+	lastSeen time.Time
+	verified bool
+}
+
+// canonicalAddr rewrites the host of addr to the canonical form of its IP, so
+// that different spellings of the same IP, such as "::ffff:1.2.3.4" and
+// "1.2.3.4", refer to the same node. Addresses whose host is not an IP are
+// returned unchanged. No DNS lookups are performed. Addresses are canonicalized
+// where they enter the gateway, i.e. in the exported methods, in the accept
+// path, and when they are added to the node list, so that the node list, peer
+// list, bans, and pins are all keyed by the canonical form.
+func canonicalAddr(addr modules.NetAddress) modules.NetAddress {
+	host, port, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+	return modules.NetAddress(net.JoinHostPort(ip.String(), port))
+}
+
+// addNode adds an address to the set of nodes on the network. If the node list
+// is full, a node is evicted to make room. The address is stored in its
+// canonical form.
 func (g *Gateway) addNode(addr modules.NetAddress) error {
-	if addr == g.myAddr {
+	addr = canonicalAddr(addr)
+	if g.isOurAddress(addr) {
 		return errOurAddress
+	} else if g.isBanned(addr) {
+		return errBannedHost
+	} else if g.isFiltered(addr) {
+		return errFilteredHost
 	} else if _, exists := g.nodes[addr]; exists {
 		return errNodeExists
 	} else if addr.IsStdValid() != nil {
@@ -27,10 +67,70 @@ func (g *Gateway) addNode(addr modules.NetAddress) error {
 	} else if net.ParseIP(addr.Host()) == nil {
 		return errors.New("address must be an IP address: " + string(addr))
 	}
-	g.nodes[addr] = struct{}{}
+	if len(g.nodes) >= maxNodeListLen && !g.evictNode() {
+		return errNodeListFull
+	}
+	g.nodes[addr] = &node{lastSeen: time.Now()}
 	return nil
 }
 
+// evictNode removes the least recently seen node that is not a peer from the
+// node list. Verified nodes are only evicted if every other node is a peer or
+// verified, so that a peer which floods the gateway with new addresses cannot
+// flush the known-good nodes out of the node list. Ties are broken at random.
+// false is returned if every node is a peer, in which case nothing is evicted.
+func (g *Gateway) evictNode() bool {
+	var victims []modules.NetAddress
+	var oldest time.Time
+	var verified bool
+	for addr, n := range g.nodes {
+		if _, isPeer := g.peers[addr]; isPeer {
+			continue
+		}
+		switch {
+		case len(victims) == 0,
+			verified && !n.verified,
+			verified == n.verified && n.lastSeen.Before(oldest):
+			victims = append(victims[:0], addr)
+			oldest, verified = n.lastSeen, n.verified
+		case verified == n.verified && n.lastSeen.Equal(oldest):
+			victims = append(victims, addr)
+		}
+	}
+	if len(victims) == 0 {
+		return false
+	}
+	delete(g.nodes, victims[fastrand.Intn(len(victims))])
+	return true
+}
+
+// markNodeSeen updates the lastSeen time of a node and marks it as verified,
+// if the node is in the node list.
+func (g *Gateway) markNodeSeen(addr modules.NetAddress) {
+	if n, exists := g.nodes[addr]; exists {
+		n.lastSeen = time.Now()
+		n.verified = true
+	}
+}
+
+// expireStaleNodes removes nodes that have not been seen for nodeExpiryAge.
+// Peers are never expired, and no nodes are removed once the node list has
+// shrunk to pruneNodeListLen.
+func (g *Gateway) expireStaleNodes() {
+	for addr, n := range g.nodes {
+		if len(g.nodes) <= pruneNodeListLen {
+			return
+		}
+		if _, isPeer := g.peers[addr]; isPeer {
+			continue
+		}
+		if time.Since(n.lastSeen) > nodeExpiryAge {
+			delete(g.nodes, addr)
+			g.log.Debugf("INFO: removing node %q because it has not been seen since %v", addr, n.lastSeen)
+		}
+	}
+}
+
 // pingNode verifies that there is a reachable node at the provided address
 // by performing the Sia gateway handshake protocol.
 func (g *Gateway) pingNode(addr modules.NetAddress) error {
@@ -66,7 +166,7 @@ func (g *Gateway) removeNode(addr modules.NetAddress) error {
 // if there are no nodes in the node list.
 func (g *Gateway) randomNode() (modules.NetAddress, error) {
 	if len(g.nodes) == 0 {
-		return "", errNoPeers
+		return "", errNoNodes
 	}
 
 	// Select a random peer. Note that the algorithm below is roughly linear in
@@ -81,14 +181,23 @@ func (g *Gateway) randomNode() (modules.NetAddress, error) {
 		}
 		r--
 	}
-	return "", errNoPeers
+	return "", errNoNodes
 }
 
 // shareNodes is the receiving end of the ShareNodes RPC. It writes up to 10
-// randomly selected nodes to the caller.
+// randomly selected nodes to the caller. The caller's own address is never
+// shared back to it.
 func (g *Gateway) shareNodes(conn modules.PeerConn) error {
 	conn.SetDeadline(time.Now().Add(connStdDeadline))
-	remoteNA := modules.NetAddress(conn.RemoteAddr().String())
+	remoteNA := canonicalAddr(modules.NetAddress(conn.RemoteAddr().String()))
+
+	// Gateways in private mode do not share their node list.
+	g.mu.RLock()
+	private := g.privateMode
+	g.mu.RUnlock()
+	if private {
+		return errPrivateMode
+	}
 
 	// Assemble a list of nodes to send to the peer.
 	var nodes []modules.NetAddress
@@ -99,6 +208,10 @@ func (g *Gateway) shareNodes(conn modules.PeerConn) error {
 		// Gather candidates for sharing.
 		gnodes := make([]modules.NetAddress, 0, len(g.nodes))
 		for node := range g.nodes {
+			// The caller already knows its own address.
+			if node == conn.RPCAddr() {
+				continue
+			}
 			// Don't share local peers with remote peers. That means that if 'node'
 			// is loopback, it will only be shared if the remote peer is also
 			// loopback. And if 'node' is private, it will only be shared if the
@@ -124,30 +237,97 @@ func (g *Gateway) shareNodes(conn modules.PeerConn) error {
 	return encoding.WriteObject(conn, nodes)
 }
 
-// requestNodes is the calling end of the ShareNodes RPC.
-func (g *Gateway) requestNodes(conn modules.PeerConn) error {
+// readSharedNodes reads the response to the ShareNodes RPC.
+func readSharedNodes(conn modules.PeerConn) ([]modules.NetAddress, error) {
 	conn.SetDeadline(time.Now().Add(connStdDeadline))
 
 	var nodes []modules.NetAddress
-	if err := encoding.ReadObject(conn, &nodes, maxSharedNodes*modules.MaxEncodedNetAddressLength); err != nil {
+	err := encoding.ReadObject(conn, &nodes, maxSharedNodes*modules.MaxEncodedNetAddressLength)
+	return nodes, err
+}
+
+// requestNodes is the calling end of the ShareNodes RPC.
+func (g *Gateway) requestNodes(conn modules.PeerConn) error {
+	nodes, err := readSharedNodes(conn)
+	if err != nil {
 		return err
 	}
 
 	g.mu.Lock()
 	for _, node := range nodes {
 		err := g.addNode(node)
-		if err != nil && err != errNodeExists && err != errOurAddress {
-			g.log.Printf("WARN: peer '%v' sent the invalid addr '%v'", conn.RPCAddr(), node)
+		if err != nil && err != errNodeExists && err != errOurAddress && err != errBannedHost && err != errFilteredHost && err != errNodeListFull {
+			g.log.Printf("WARN: peer '%v' sent the invalid addr %q", conn.RPCAddr(), node)
 		}
 	}
-	err := g.saveSync()
+	g.mu.Unlock()
+	err = g.managedSaveSync()
 	if err != nil {
 		g.log.Println("ERROR: unable to save new nodes added to the gateway:", err)
 	}
-	g.mu.Unlock()
 	return nil
 }
 
+// RequestNodes calls the ShareNodes RPC on a connected peer and returns the
+// valid addresses that it shares, without adding them to the node list. The
+// peer chooses which nodes to share, up to maxSharedNodes.
+func (g *Gateway) RequestNodes(addr modules.NetAddress) ([]modules.NetAddress, error) {
+	if err := g.threads.Add(); err != nil {
+		return nil, err
+	}
+	defer g.threads.Done()
+
+	var nodes []modules.NetAddress
+	err := g.managedRPC(addr, "ShareNodes", func(conn modules.PeerConn) error {
+		shared, err := readSharedNodes(conn)
+		if err != nil {
+			return err
+		}
+		for _, node := range shared {
+			if node.IsStdValid() == nil && net.ParseIP(node.Host()) != nil {
+				nodes = append(nodes, node)
+			}
+		}
+		return nil
+	})
+	return nodes, err
+}
+
+// MergeNodes adds a batch of addresses to the node list, e.g. to seed a
+// gateway with the node list of another trusted node. The addresses are
+// subject to the same validation, bans, and peer filter as nodes learned from
+// peers, and are not pinged. The number of addresses that were added is
+// returned.
+func (g *Gateway) MergeNodes(addrs []modules.NetAddress) (int, error) {
+	if err := g.threads.Add(); err != nil {
+		return 0, err
+	}
+	defer g.threads.Done()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var added int
+	for _, addr := range addrs {
+		if g.addNode(addr) == nil {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// NodeLastSeen returns the time that the node at addr was last added to the
+// node list or confirmed to be reachable. Nodes that go unseen for too long
+// are removed from the node list.
+func (g *Gateway) NodeLastSeen(addr modules.NetAddress) (time.Time, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	n, exists := g.nodes[canonicalAddr(addr)]
+	if !exists {
+		return time.Time{}, errors.New("no record of that node")
+	}
+	return n.lastSeen, nil
+}
+
 // permanentNodePurger is a thread that runs throughout the lifetime of the
 // gateway, purging unconnectable nodes from the node list in a sustainable
 // way.
@@ -186,6 +366,11 @@ func (g *Gateway) permanentNodePurger(closeChan chan struct{}) {
 			return
 		}
 
+		// Remove any nodes that have not been seen in a long time.
+		g.mu.Lock()
+		g.expireStaleNodes()
+		g.mu.Unlock()
+
 		// Get a random node for scanning.
 		g.mu.RLock()
 		numNodes := len(g.nodes)
@@ -228,7 +413,11 @@ func (g *Gateway) permanentNodePurger(closeChan chan struct{}) {
 			g.removeNode(node)
 			g.mu.Unlock()
 			g.log.Debugf("INFO: removing node %q because it could not be reached during a random scan: %v", node, err)
+			continue
 		}
+		g.mu.Lock()
+		g.markNodeSeen(node)
+		g.mu.Unlock()
 	}
 }
 
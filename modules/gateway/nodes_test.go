@@ -1,8 +1,11 @@
 package gateway
 
 import (
+	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -40,9 +43,82 @@ func TestAddNode(t *testing.T) {
 	if err := g.addNode("[::]:9981"); err == nil {
 		t.Error("addNode added unspecified address")
 	}
+	if err := g.addNode("0.0.0.0:9981"); err == nil {
+		t.Error("addNode added unspecified address")
+	}
+	if err := g.addNode("111.111.111.111:0"); err == nil {
+		t.Error("addNode added an address with port 0")
+	}
+	if err := g.addNode("111.111.111.111\n:9981"); err == nil {
+		t.Error("addNode added an address containing a control character")
+	}
+	if err := g.addNode(modules.NetAddress(strings.Repeat("1", 300) + ":9981")); err == nil {
+		t.Error("addNode added an address with an oversized host")
+	}
 	if err := g.addNode(g.myAddr); err != errOurAddress {
 		t.Error("addNode added our own address")
 	}
+	if err := g.addNode(modules.NetAddress(net.JoinHostPort("127.0.0.2", g.port))); err != errOurAddress {
+		t.Error("addNode added an alias of our own address")
+	}
+
+	// Different spellings of the same IP should be stored as a single node.
+	if err := g.addNode("[::ffff:111.111.111.112]:9981"); err != nil {
+		t.Fatal("addNode failed:", err)
+	}
+	if err := g.addNode("111.111.111.112:9981"); err != errNodeExists {
+		t.Error("addNode added an alias of an existing node")
+	}
+	if err := g.addNode("[2001:db8:0::1]:9981"); err != nil {
+		t.Fatal("addNode failed:", err)
+	}
+	if err := g.addNode("[2001:0db8::0001]:9981"); err != errNodeExists {
+		t.Error("addNode added an alias of an existing node")
+	}
+	if _, ok := g.nodes["111.111.111.112:9981"]; !ok {
+		t.Error("node was not stored in canonical form")
+	}
+}
+
+// TestMergeNodes checks that MergeNodes adds only the valid, unbanned
+// addresses in a batch and reports how many were added.
+func TestMergeNodes(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	if err := g.Ban("222.222.222.222:9981"); err != nil {
+		t.Fatal(err)
+	}
+	batch := []modules.NetAddress{
+		"111.111.111.111:9981",
+		"111.111.111.112:9981",
+		"111.111.111.111:9981", // duplicate
+		"foo:9981",             // not an IP
+		"111.111.111.113:0",    // invalid port
+		"222.222.222.222:9982", // banned host
+		g.Address(),            // our own address
+	}
+	added, err := g.MergeNodes(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Fatal("expected 2 nodes to be added, got", added)
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, addr := range batch[:2] {
+		if _, exists := g.nodes[addr]; !exists {
+			t.Error("valid node was not added:", addr)
+		}
+	}
+	if _, exists := g.nodes["222.222.222.222:9982"]; exists {
+		t.Error("banned node was added")
+	}
 }
 
 // TestRemoveNode tries remiving a node from the gateway.
@@ -81,7 +157,7 @@ func TestRandomNode(t *testing.T) {
 	g.mu.RLock()
 	_, err := g.randomNode()
 	g.mu.RUnlock()
-	if err != errNoPeers {
+	if err != errNoNodes {
 		t.Fatal("randomNode should fail when the gateway has 0 nodes")
 	}
 
@@ -110,8 +186,8 @@ func TestRandomNode(t *testing.T) {
 	g.mu.RLock()
 	_, err = g.randomNode()
 	g.mu.RUnlock()
-	if err != errNoPeers {
-		t.Fatalf("randomNode returned wrong error: expected %v, got %v", errNoPeers, err)
+	if err != errNoNodes {
+		t.Fatalf("randomNode returned wrong error: expected %v, got %v", errNoNodes, err)
 	}
 
 	// Test with 3 nodes.
@@ -145,6 +221,252 @@ func TestRandomNode(t *testing.T) {
 	}
 }
 
+// TestRandomNodeDistribution checks that randomNode selects nodes uniformly,
+// rather than being biased by the order of map iteration.
+func TestRandomNodeDistribution(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	const numNodes = 10
+	const numDraws = 10e3
+	counts := make(map[modules.NetAddress]int)
+	g.mu.Lock()
+	for i := 1; i <= numNodes; i++ {
+		addr := modules.NetAddress("111.111.111.111:" + strconv.Itoa(i))
+		if err := g.addNode(addr); err != nil {
+			t.Fatal(err)
+		}
+		counts[addr] = 0
+	}
+	g.mu.Unlock()
+
+	g.mu.RLock()
+	for i := 0; i < numDraws; i++ {
+		addr, err := g.randomNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[addr]++
+	}
+	g.mu.RUnlock()
+
+	// Each node is expected 1000 times with a standard deviation of ~30, so
+	// a 30% tolerance will essentially never fail for a uniform selection.
+	for addr, count := range counts {
+		if count < numDraws/numNodes*7/10 || count > numDraws/numNodes*13/10 {
+			t.Errorf("node %v was selected %v times, expected ~%v", addr, count, numDraws/numNodes)
+		}
+	}
+}
+
+// TestNodeListCap checks that the node list does not grow beyond
+// maxNodeListLen, that the least recently seen nodes are evicted to make room
+// for new ones, that verified nodes are not flushed out by a flood of new
+// nodes, and that peers are never evicted.
+func TestNodeListCap(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Fill the node list with nodes that were seen one minute apart. Every
+	// tenth node has been verified, and the oldest node is a peer.
+	start := time.Now().Add(-24 * time.Hour)
+	var original []modules.NetAddress
+	for i := 0; i < maxNodeListLen; i++ {
+		addr := modules.NetAddress("111.111.111.111:" + strconv.Itoa(i+1))
+		if err := g.addNode(addr); err != nil {
+			t.Fatal(err)
+		}
+		g.nodes[addr].lastSeen = start.Add(time.Duration(i) * time.Minute)
+		g.nodes[addr].verified = i%10 == 0
+		original = append(original, addr)
+	}
+	peerAddr := original[0]
+	g.peers[peerAddr] = &peer{Peer: modules.Peer{NetAddress: peerAddr}}
+	defer delete(g.peers, peerAddr)
+
+	// Add half as many new nodes as the node list can hold. The oldest
+	// unverified nodes should be evicted, and everything else kept.
+	var added []modules.NetAddress
+	for i := 0; i < maxNodeListLen/2; i++ {
+		addr := modules.NetAddress("222.222.222.222:" + strconv.Itoa(i+1))
+		if err := g.addNode(addr); err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, addr)
+	}
+	if len(g.nodes) != maxNodeListLen {
+		t.Fatalf("expected %v nodes, got %v", maxNodeListLen, len(g.nodes))
+	}
+	var evicted int
+	for i, addr := range original {
+		_, exists := g.nodes[addr]
+		if i%10 == 0 && !exists {
+			t.Fatalf("verified node or peer %v was evicted", addr)
+		}
+		if !exists {
+			evicted++
+		} else if evicted < maxNodeListLen/2 && i%10 != 0 {
+			t.Fatalf("node %v was kept while an older node was evicted", addr)
+		}
+	}
+	for _, addr := range added {
+		if _, exists := g.nodes[addr]; !exists {
+			t.Fatalf("new node %v was evicted", addr)
+		}
+	}
+
+	// Flood the node list. The new nodes replace each other and the original
+	// unverified nodes, but not the verified nodes or the peer.
+	for i := 0; i < 2*maxNodeListLen; i++ {
+		addr := modules.NetAddress("233.233.233.233:" + strconv.Itoa(i+1))
+		if err := g.addNode(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(g.nodes) != maxNodeListLen {
+		t.Fatalf("expected %v nodes, got %v", maxNodeListLen, len(g.nodes))
+	}
+	for i := 0; i < maxNodeListLen; i += 10 {
+		if _, exists := g.nodes[original[i]]; !exists {
+			t.Fatalf("verified node or peer %v was evicted by a flood of new nodes", original[i])
+		}
+	}
+
+	// Once every node is a peer, no new nodes can be added.
+	for addr := range g.nodes {
+		if _, isPeer := g.peers[addr]; !isPeer {
+			g.peers[addr] = &peer{Peer: modules.Peer{NetAddress: addr}}
+			defer delete(g.peers, addr)
+		}
+	}
+	if err := g.addNode(dummyNode); err != errNodeListFull {
+		t.Fatalf("expected %v, got %v", errNodeListFull, err)
+	}
+	if len(g.nodes) != maxNodeListLen {
+		t.Fatalf("expected %v nodes, got %v", maxNodeListLen, len(g.nodes))
+	}
+}
+
+// TestExpireStaleNodes checks that nodes which have not been seen for
+// nodeExpiryAge are removed from the node list, while recently seen nodes and
+// peers are kept.
+func TestExpireStaleNodes(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i := 1; i <= pruneNodeListLen+5; i++ {
+		err := g.addNode(modules.NetAddress("111.111.111.111:" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale := []modules.NetAddress{"111.111.111.111:1", "111.111.111.111:2", "111.111.111.111:3"}
+	for _, addr := range stale {
+		g.nodes[addr].lastSeen = time.Now().Add(-2 * nodeExpiryAge)
+	}
+	g.expireStaleNodes()
+	if len(g.nodes) != pruneNodeListLen+2 {
+		t.Fatalf("expected %v nodes, got %v", pruneNodeListLen+2, len(g.nodes))
+	}
+	for _, addr := range stale {
+		if _, exists := g.nodes[addr]; exists {
+			t.Error("stale node was not expired:", addr)
+		}
+	}
+
+	// Once the node list is at pruneNodeListLen, nothing should be expired.
+	for addr, n := range g.nodes {
+		n.lastSeen = time.Now().Add(-2 * nodeExpiryAge)
+		if len(g.nodes) > pruneNodeListLen {
+			delete(g.nodes, addr)
+		}
+	}
+	g.expireStaleNodes()
+	if len(g.nodes) != pruneNodeListLen {
+		t.Fatalf("expected %v nodes, got %v", pruneNodeListLen, len(g.nodes))
+	}
+}
+
+// TestConcurrentNodeAccess spins up many threads that add nodes to the
+// gateway while other threads read the node and peer lists, both directly and
+// through the ShareNodes RPC of a connected peer, and register and unregister
+// RPC handlers. The race detector checks the gateway's own locking, as no
+// internal methods are called.
+func TestConcurrentNodeAccess(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+	if err := g2.Connect(g1.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var added uint64
+	errChan := make(chan error, 250)
+	for i := 1; i <= 250; i++ {
+		addr := modules.NetAddress("111.111.111.111:" + strconv.Itoa(i))
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			n, err := g1.MergeNodes([]modules.NetAddress{addr})
+			if err != nil {
+				errChan <- err
+			}
+			atomic.AddUint64(&added, uint64(n))
+		}()
+		go func() {
+			defer wg.Done()
+			g1.Peers()
+			g1.NodeLastSeen(addr)
+			g1.NetworkMetrics()
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if i%10 != 0 {
+				return
+			}
+			name := "Foo" + strconv.Itoa(i)
+			g1.RegisterRPC(name, func(modules.PeerConn) error { return nil })
+			if _, err := g2.RequestNodes(g1.Address()); err != nil {
+				errChan <- err
+			}
+			g1.UnregisterRPC(name)
+		}(i)
+	}
+	wg.Wait()
+	close(errChan)
+	for err := range errChan {
+		t.Fatal(err)
+	}
+
+	// The node purger may already have removed some of the unreachable nodes,
+	// so only the number of nodes that were added is checked.
+	if added != 250 {
+		t.Fatalf("expected 250 nodes to be added, got %v", added)
+	}
+}
+
 // TestShareNodes checks that two gateways will share nodes with eachother
 // following the desired sharing strategy.
 func TestShareNodes(t *testing.T) {
@@ -182,10 +504,10 @@ func TestShareNodes(t *testing.T) {
 
 	// remove all nodes from both peers
 	g1.mu.Lock()
-	g1.nodes = map[modules.NetAddress]struct{}{}
+	g1.nodes = map[modules.NetAddress]*node{}
 	g1.mu.Unlock()
 	g2.mu.Lock()
-	g2.nodes = map[modules.NetAddress]struct{}{}
+	g2.nodes = map[modules.NetAddress]*node{}
 	g2.mu.Unlock()
 
 	// SharePeers should now return no peers
@@ -200,6 +522,23 @@ func TestShareNodes(t *testing.T) {
 		t.Fatal("gateway gave non-existent addresses:", nodes)
 	}
 
+	// the caller's own address should never be shared back to it
+	g2.mu.Lock()
+	err = g2.addNode(g1.Address())
+	g2.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g1.RPC(g2.Address(), "ShareNodes", func(conn modules.PeerConn) error {
+		return encoding.ReadObject(conn, &nodes, maxSharedNodes*modules.MaxEncodedNetAddressLength)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Fatal("gateway shared the caller's own address:", nodes)
+	}
+
 	// sharing should be capped at maxSharedNodes
 	for i := 1; i < int(maxSharedNodes)+11; i++ {
 		g2.mu.Lock()
@@ -220,6 +559,46 @@ func TestShareNodes(t *testing.T) {
 	}
 }
 
+// TestRequestNodes checks that RequestNodes returns nodes from the peer's
+// node list.
+func TestRequestNodes(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	known := map[modules.NetAddress]*node{
+		"111.111.111.111:1": {lastSeen: time.Now()},
+		"111.111.111.111:2": {lastSeen: time.Now()},
+	}
+	g2.mu.Lock()
+	g2.nodes = make(map[modules.NetAddress]*node)
+	for addr, n := range known {
+		g2.nodes[addr] = n
+	}
+	g2.mu.Unlock()
+
+	nodes, err := g1.RequestNodes(g2.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != len(known) {
+		t.Fatalf("expected %v nodes, got %v", len(known), nodes)
+	}
+	for _, node := range nodes {
+		if _, ok := known[node]; !ok {
+			t.Fatal("RequestNodes returned an unknown node:", node)
+		}
+	}
+}
+
 // TestNodesAreSharedOnConnect tests that nodes that a gateway has never seen
 // before are added to the node list when connecting to another gateway that
 // has seen said nodes.
@@ -459,3 +838,63 @@ func TestHealthyNodeListPruning(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestPrivateMode checks that a gateway in private mode can connect to peers
+// and request nodes from them, but neither shares its node list nor accepts
+// inbound connections, so peers do not add it to their node lists.
+func TestPrivateMode(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+	g1.SetPrivateMode(true)
+
+	g1.mu.Lock()
+	err := g1.addNode(dummyNode)
+	g1.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2.mu.Lock()
+	err = g2.addNode("111.111.111.112:9981")
+	g2.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// g1 can connect to g2 and request its nodes.
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g1.RequestNodes(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	// g2 cannot request g1's nodes, and does not learn g1's address.
+	if _, err := g2.RequestNodes(g1.Address()); err == nil {
+		t.Fatal("gateway in private mode shared its nodes")
+	}
+	time.Sleep(500 * time.Millisecond)
+	g2.mu.RLock()
+	_, knowsG1 := g2.nodes[g1.Address()]
+	_, knowsDummy := g2.nodes[dummyNode]
+	g2.mu.RUnlock()
+	if knowsG1 {
+		t.Error("peer added a gateway in private mode to its node list")
+	}
+	if knowsDummy {
+		t.Error("gateway in private mode shared its nodes")
+	}
+
+	// g2 cannot connect to g1.
+	if err := g1.Disconnect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g2.Connect(g1.Address()); err == nil {
+		t.Fatal("gateway in private mode accepted an inbound connection")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/NebulousLabs/Sia/build"
@@ -14,6 +15,7 @@ import (
 )
 
 var (
+	errNoPeerLatencies  = errors.New("no peer latencies have been measured")
 	errPeerExists       = errors.New("already connected to this peer")
 	errPeerRejectedConn = errors.New("peer rejected connection")
 )
@@ -37,6 +39,14 @@ func (s invalidVersionError) Error() string {
 type peer struct {
 	modules.Peer
 	sess muxado.Session
+
+	// latency is the round trip time of the most recent successful ping of
+	// the peer, or 0 if the peer has not been pinged yet.
+	//
+	// pingFailures is the number of consecutive health check pings that the
+	// peer has failed.
+	latency      time.Duration
+	pingFailures int
 }
 
 func (p *peer) open() (modules.PeerConn, error) {
@@ -80,6 +90,17 @@ func (g *Gateway) randomOutboundPeer() (modules.NetAddress, error) {
 	return addrs[fastrand.Intn(len(addrs))], nil
 }
 
+// numInboundPeersFromHost returns the number of inbound peers whose address
+// has the same host as addr.
+func (g *Gateway) numInboundPeersFromHost(addr modules.NetAddress) (n int) {
+	for _, p := range g.peers {
+		if p.Inbound && p.NetAddress.Host() == addr.Host() {
+			n++
+		}
+	}
+	return n
+}
+
 // permanentListen handles incoming connection requests. If the connection is
 // accepted, the peer will be added to the Gateway's peer list.
 func (g *Gateway) permanentListen(closeChan chan struct{}) {
@@ -88,12 +109,26 @@ func (g *Gateway) permanentListen(closeChan chan struct{}) {
 
 	for {
 		conn, err := g.listener.Accept()
-		if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			// Temporary errors, such as running out of file descriptors,
+			// should not stop the gateway from accepting peers.
+			g.log.Debugln("WARN: temporary error accepting connection:", err)
+			select {
+			case <-time.After(acceptRetryDelay):
+				continue
+			case <-g.threads.StopChan():
+				return
+			}
+		} else if err != nil {
 			g.log.Debugln("[PL] Closing permanentListen:", err)
 			return
 		}
 
-		go g.threadedAcceptConn(conn)
+		g.mu.RLock()
+		period := g.keepAlivePeriod
+		g.mu.RUnlock()
+		enableKeepAlive(conn, period)
+		go g.threadedAcceptConn(meteredConn{Conn: conn, g: g})
 
 		// Sleep after each accept. This limits the rate at which the Gateway
 		// will accept new connections. The intent here is to prevent new
@@ -116,9 +151,36 @@ func (g *Gateway) threadedAcceptConn(conn net.Conn) {
 	defer g.threads.Done()
 	conn.SetDeadline(time.Now().Add(connStdDeadline))
 
-	addr := modules.NetAddress(conn.RemoteAddr().String())
+	addr := canonicalAddr(modules.NetAddress(conn.RemoteAddr().String()))
 	g.log.Debugf("INFO: %v wants to connect", addr)
 
+	g.mu.RLock()
+	private := g.privateMode
+	banned := g.isBanned(addr)
+	filtered := g.isFiltered(addr)
+	hostFull := !addr.IsLocal() && g.numInboundPeersFromHost(addr) >= maxInboundPeersPerHost
+	g.mu.RUnlock()
+	if private {
+		g.log.Debugf("INFO: rejecting connection from %v, gateway is in private mode", addr)
+		conn.Close()
+		return
+	}
+	if banned {
+		g.log.Debugf("INFO: rejecting connection from banned host %v", addr)
+		conn.Close()
+		return
+	}
+	if filtered {
+		g.log.Debugf("INFO: rejecting connection from %v, rejected by the peer filter", addr)
+		conn.Close()
+		return
+	}
+	if hostFull {
+		g.log.Debugf("INFO: rejecting connection from %v, too many inbound peers share its host", addr)
+		conn.Close()
+		return
+	}
+
 	remoteVersion, err := acceptConnVersionHandshake(conn, build.Version)
 	if err != nil {
 		g.log.Debugf("INFO: %v wanted to connect but version handshake failed: %v", addr, err)
@@ -147,7 +209,7 @@ func (g *Gateway) threadedAcceptConn(conn net.Conn) {
 // (older peers do not share their dialback address). The peer is only added if
 // a nil error is returned.
 func (g *Gateway) managedAcceptConnOldPeer(conn net.Conn, remoteVersion string) error {
-	addr := modules.NetAddress(conn.RemoteAddr().String())
+	addr := canonicalAddr(modules.NetAddress(conn.RemoteAddr().String()))
 
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -206,6 +268,7 @@ func (g *Gateway) managedAcceptConnNewPeer(conn net.Conn, remoteVersion string)
 		if err == nil {
 			g.mu.Lock()
 			g.addNode(remoteAddr)
+			g.markNodeSeen(remoteAddr)
 			g.mu.Unlock()
 		}
 	}()
@@ -254,8 +317,8 @@ func (g *Gateway) acceptPeer(p *peer) {
 }
 
 // acceptConnPortHandshake performs the port handshake and should be called on
-// the side accepting a connection request. The remote address is only returned
-// if err == nil.
+// the side accepting a connection request. The remote address is returned in
+// its canonical form, and only if err == nil.
 func acceptConnPortHandshake(conn net.Conn) (remoteAddr modules.NetAddress, err error) {
 	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
@@ -278,7 +341,7 @@ func acceptConnPortHandshake(conn net.Conn) (remoteAddr modules.NetAddress, err
 	if remoteAddr.Host() != host {
 		return "", fmt.Errorf("peer sent a port which modified the host")
 	}
-	return remoteAddr, nil
+	return canonicalAddr(remoteAddr), nil
 }
 
 // connectPortHandshake performs the port handshake and should be called on the
@@ -350,8 +413,15 @@ func acceptConnVersionHandshake(conn net.Conn, version string) (remoteVersion st
 // managedConnectOldPeer connects to peers < v1.0.0. The peer is added as a
 // node and a peer. The peer is only added if a nil error is returned.
 func (g *Gateway) managedConnectOldPeer(conn net.Conn, remoteVersion string, remoteAddr modules.NetAddress) error {
+	// Drop the peer before adding it if it cannot prove ownership of its
+	// pinned identity key.
+	sess := muxado.Client(conn)
+	if err := g.managedVerifyPinnedIdentity(sess, remoteAddr); err != nil {
+		sess.Close()
+		return err
+	}
+
 	g.mu.Lock()
-	defer g.mu.Unlock()
 	g.addPeer(&peer{
 		Peer: modules.Peer{
 			Inbound:    false,
@@ -359,15 +429,17 @@ func (g *Gateway) managedConnectOldPeer(conn net.Conn, remoteVersion string, rem
 			NetAddress: remoteAddr,
 			Version:    remoteVersion,
 		},
-		sess: muxado.Client(conn),
+		sess: sess,
 	})
 	// Add the peer to the node list. We can ignore the error: addNode
 	// validates the address and checks for duplicates, but we don't care
 	// about duplicates and we have already validated the address by
 	// connecting to it.
 	g.addNode(remoteAddr)
+	g.markNodeSeen(remoteAddr)
+	g.mu.Unlock()
 	// We want to persist the outbound peers.
-	err := g.saveSync()
+	err := g.managedSaveSync()
 	if err != nil {
 		g.log.Println("ERROR: Unable to save new outbound peer to gateway:", err)
 	}
@@ -386,9 +458,15 @@ func (g *Gateway) managedConnectNewPeer(conn net.Conn, remoteVersion string, rem
 	if err != nil {
 		return err
 	}
+	// Drop the peer before adding it if it cannot prove ownership of its
+	// pinned identity key.
+	sess := muxado.Client(conn)
+	if err := g.managedVerifyPinnedIdentity(sess, remoteAddr); err != nil {
+		sess.Close()
+		return err
+	}
 
 	g.mu.Lock()
-	defer g.mu.Unlock()
 	g.addPeer(&peer{
 		Peer: modules.Peer{
 			Inbound:    false,
@@ -396,15 +474,17 @@ func (g *Gateway) managedConnectNewPeer(conn net.Conn, remoteVersion string, rem
 			NetAddress: remoteAddr,
 			Version:    remoteVersion,
 		},
-		sess: muxado.Client(conn),
+		sess: sess,
 	})
 	// Add the peer to the node list. We can ignore the error: addNode
 	// validates the address and checks for duplicates, but we don't care
 	// about duplicates and we have already validated the address by
 	// connecting to it.
 	g.addNode(remoteAddr)
+	g.markNodeSeen(remoteAddr)
+	g.mu.Unlock()
 	// We want to persist the outbound peers.
-	err = g.saveSync()
+	err = g.managedSaveSync()
 	if err != nil {
 		g.log.Println("ERROR: Unable to save new outbound peer to gateway:", err)
 	}
@@ -415,11 +495,12 @@ func (g *Gateway) managedConnectNewPeer(conn net.Conn, remoteVersion string, rem
 // the Gateway's peer list.
 func (g *Gateway) managedConnect(addr modules.NetAddress) error {
 	// Perform verification on the input address.
+	addr = canonicalAddr(addr)
 	g.mu.RLock()
-	gaddr := g.myAddr
+	ourAddr := g.isOurAddress(addr)
 	g.mu.RUnlock()
-	if addr == gaddr {
-		return errors.New("can't connect to our own address")
+	if ourAddr {
+		return errOurAddress
 	}
 	if err := addr.IsStdValid(); err != nil {
 		return errors.New("can't connect to invalid address")
@@ -429,8 +510,14 @@ func (g *Gateway) managedConnect(addr modules.NetAddress) error {
 	}
 	g.mu.RLock()
 	_, exists := g.peers[addr]
+	banned := g.isBanned(addr)
+	filtered := g.isFiltered(addr)
 	g.mu.RUnlock()
-	if exists {
+	if banned {
+		return errBannedHost
+	} else if filtered {
+		return errFilteredHost
+	} else if exists {
 		return errPeerExists
 	}
 
@@ -499,6 +586,7 @@ func (g *Gateway) Disconnect(addr modules.NetAddress) error {
 	}
 	defer g.threads.Done()
 
+	addr = canonicalAddr(addr)
 	g.mu.RLock()
 	p, exists := g.peers[addr]
 	g.mu.RUnlock()
@@ -516,6 +604,143 @@ func (g *Gateway) Disconnect(addr modules.NetAddress) error {
 	return nil
 }
 
+// managedPeerConnected calls the connect hooks for a peer.
+func (g *Gateway) managedPeerConnected(addr modules.NetAddress) {
+	g.mu.RLock()
+	hooks := g.connectHooks
+	g.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(addr)
+	}
+}
+
+// managedPeerDisconnected calls the disconnect hooks for a peer.
+func (g *Gateway) managedPeerDisconnected(addr modules.NetAddress) {
+	g.mu.RLock()
+	hooks := g.disconnectHooks
+	g.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(addr)
+	}
+}
+
+// OnPeerConnect registers a function to be called with the address of every
+// peer that the gateway connects to, inbound or outbound. Hooks are called
+// without holding the gateway lock, but they hold up the peer's connection
+// while they run, so long-running work should be done in a new goroutine.
+func (g *Gateway) OnPeerConnect(fn func(modules.NetAddress)) {
+	g.mu.Lock()
+	g.connectHooks = append(g.connectHooks, fn)
+	g.mu.Unlock()
+}
+
+// OnPeerDisconnect registers a function to be called with the address of
+// every peer whose connection closes, whether the peer disconnected, was
+// kicked, banned, or dropped for failing to respond. It is called once for
+// every call to the OnPeerConnect hooks, and under the same conditions.
+func (g *Gateway) OnPeerDisconnect(fn func(modules.NetAddress)) {
+	g.mu.Lock()
+	g.disconnectHooks = append(g.disconnectHooks, fn)
+	g.mu.Unlock()
+}
+
+// BestPeer returns the peer with the lowest measured latency. Peer latencies
+// are measured by Ping and by the periodic peer health check; peers that have
+// not been pinged yet are not considered.
+func (g *Gateway) BestPeer() (modules.NetAddress, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var best *peer
+	for _, p := range g.peers {
+		if p.latency > 0 && (best == nil || p.latency < best.latency) {
+			best = p
+		}
+	}
+	if best == nil {
+		return "", errNoPeerLatencies
+	}
+	return best.NetAddress, nil
+}
+
+// WeightedRandomPeer returns a random peer, where the chance of selecting a
+// peer is inversely proportional to its measured latency. Peers that have not
+// been pinged yet are not considered.
+func (g *Gateway) WeightedRandomPeer() (modules.NetAddress, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var addrs []modules.NetAddress
+	var weights []int
+	total := 0
+	for addr, p := range g.peers {
+		if p.latency <= 0 {
+			continue
+		}
+		weight := int(time.Second/p.latency) + 1
+		addrs = append(addrs, addr)
+		weights = append(weights, weight)
+		total += weight
+	}
+	if len(addrs) == 0 {
+		return "", errNoPeerLatencies
+	}
+	r := fastrand.Intn(total)
+	for i, weight := range weights {
+		if r < weight {
+			return addrs[i], nil
+		}
+		r -= weight
+	}
+	return addrs[len(addrs)-1], nil
+}
+
+// peerLatency is a peer with the information used to order peers by latency.
+type peerLatency struct {
+	modules.Peer
+	latency  time.Duration
+	lastSeen time.Time
+}
+
+// byLatency sorts peers by measured latency, fastest first. Peers that have
+// not been pinged come last, ordered by how recently they were seen.
+type byLatency []peerLatency
+
+func (bl byLatency) Len() int      { return len(bl) }
+func (bl byLatency) Swap(i, j int) { bl[i], bl[j] = bl[j], bl[i] }
+func (bl byLatency) Less(i, j int) bool {
+	li, lj := bl[i].latency, bl[j].latency
+	switch {
+	case li > 0 && lj > 0:
+		return li < lj
+	case li > 0 || lj > 0:
+		return li > 0
+	default:
+		return bl[i].lastSeen.After(bl[j].lastSeen)
+	}
+}
+
+// PeersByLatency returns the peers currently connected to the Gateway, ordered
+// by their measured latency, fastest first. Peers that have not been pinged
+// yet are placed after the others, most recently seen first.
+func (g *Gateway) PeersByLatency() []modules.Peer {
+	g.mu.RLock()
+	pls := make(byLatency, 0, len(g.peers))
+	for addr, p := range g.peers {
+		pl := peerLatency{Peer: p.Peer, latency: p.latency}
+		if n, exists := g.nodes[addr]; exists {
+			pl.lastSeen = n.lastSeen
+		}
+		pls = append(pls, pl)
+	}
+	g.mu.RUnlock()
+
+	sort.Sort(pls)
+	peers := make([]modules.Peer, len(pls))
+	for i, pl := range pls {
+		peers[i] = pl.Peer
+	}
+	return peers
+}
+
 // Peers returns the addresses currently connected to the Gateway.
 func (g *Gateway) Peers() []modules.Peer {
 	g.mu.RLock()
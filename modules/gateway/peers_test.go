@@ -1,14 +1,19 @@
 package gateway
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/NebulousLabs/Sia/build"
 	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/persist"
 	"github.com/NebulousLabs/fastrand"
 	"github.com/NebulousLabs/muxado"
 )
@@ -274,6 +279,234 @@ func TestListen(t *testing.T) {
 	}
 }
 
+// fixedAddrConn is a net.Conn that reports a fixed remote address.
+type fixedAddrConn struct {
+	net.Conn
+	remoteAddr modules.NetAddress
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (c fixedAddrConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// temporaryError is a net.Error that reports itself as temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener is a net.Listener whose Accept returns temporaryErrs temporary
+// errors followed by a permanent one.
+type flakyListener struct {
+	net.Listener
+	temporaryErrs int
+	accepts       int
+}
+
+// Accept implements the net.Listener interface.
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if l.accepts <= l.temporaryErrs {
+		return nil, temporaryError{}
+	}
+	return nil, errors.New("listener closed")
+}
+
+// TestPermanentListenTemporaryError checks that permanentListen keeps
+// accepting connections after a temporary error and only exits on a permanent
+// one.
+func TestPermanentListenTemporaryError(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	l := &flakyListener{temporaryErrs: 3}
+	g := &Gateway{
+		listener: l,
+		log:      persist.NewLogger(ioutil.Discard),
+	}
+
+	closeChan := make(chan struct{})
+	go g.permanentListen(closeChan)
+	select {
+	case <-closeChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("permanentListen did not exit after a permanent error")
+	}
+	if l.accepts != l.temporaryErrs+1 {
+		t.Fatalf("expected %v calls to Accept, got %v", l.temporaryErrs+1, l.accepts)
+	}
+}
+
+// keepAliveRecorder is a net.Conn that records the keepalive settings applied
+// to it.
+type keepAliveRecorder struct {
+	fixedAddrConn
+
+	mu      sync.Mutex
+	enabled bool
+	period  time.Duration
+}
+
+// SetKeepAlive implements the keepAliveConn interface.
+func (c *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = keepalive
+	return nil
+}
+
+// SetKeepAlivePeriod implements the keepAliveConn interface.
+func (c *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.period = d
+	return nil
+}
+
+// settings returns the recorded keepalive settings.
+func (c *keepAliveRecorder) settings() (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enabled, c.period
+}
+
+// singleConnListener is a net.Listener whose Accept returns conn once,
+// followed by a permanent error.
+type singleConnListener struct {
+	net.Listener
+	conn     net.Conn
+	accepted bool
+}
+
+// Accept implements the net.Listener interface.
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if l.accepted {
+		return nil, errors.New("listener closed")
+	}
+	l.accepted = true
+	return l.conn, nil
+}
+
+// dialerFunc is a function that implements the Dialer interface.
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+// Dial implements the Dialer interface.
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) { return f(network, addr) }
+
+// TestKeepAlive checks that accepted and dialed connections have keepalives
+// enabled with the period set by SetKeepAlivePeriod.
+func TestKeepAlive(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	period := 42 * time.Second
+
+	// Accepted connections. The gateway is in private mode, so the connection
+	// is closed right after it has been accepted.
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	accepted := &keepAliveRecorder{fixedAddrConn: fixedAddrConn{ours, "127.0.0.1:9999"}}
+	g := &Gateway{
+		listener:    &singleConnListener{conn: accepted},
+		log:         persist.NewLogger(ioutil.Discard),
+		privateMode: true,
+	}
+	if err := g.SetKeepAlivePeriod(0); err == nil {
+		t.Fatal("expected an error when setting a keepalive period of 0")
+	}
+	if err := g.SetKeepAlivePeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	go g.permanentListen(closeChan)
+	select {
+	case <-closeChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("permanentListen did not exit after a permanent error")
+	}
+	if enabled, p := accepted.settings(); !enabled || p != period {
+		t.Errorf("accepted connection has keepalive %v with period %v, expected a period of %v", enabled, p, period)
+	}
+
+	// Dialed connections.
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+	if err := g1.SetKeepAlivePeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var dialed []*keepAliveRecorder
+	g1.SetDialer(dialerFunc(func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		kc := &keepAliveRecorder{fixedAddrConn: fixedAddrConn{conn, modules.NetAddress(addr)}}
+		mu.Lock()
+		dialed = append(dialed, kc)
+		mu.Unlock()
+		return kc, nil
+	}))
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) == 0 {
+		t.Fatal("the dialer was not used")
+	}
+	for _, kc := range dialed {
+		if enabled, p := kc.settings(); !enabled || p != period {
+			t.Errorf("dialed connection has keepalive %v with period %v, expected a period of %v", enabled, p, period)
+		}
+	}
+}
+
+// TestAcceptConnPerHostLimit checks that the gateway refuses inbound
+// connections from a host that already has maxInboundPeersPerHost inbound
+// peers, while still accepting connections from other hosts.
+func TestAcceptConnPerHostLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	// The gateway is built without its background threads, which would
+	// otherwise remove the fake peers.
+	g := &Gateway{
+		peers: make(map[modules.NetAddress]*peer),
+		nodes: make(map[modules.NetAddress]*node),
+		log:   persist.NewLogger(ioutil.Discard),
+	}
+
+	// Fill up the inbound slots for 1.2.3.4.
+	for i := 0; i < maxInboundPeersPerHost; i++ {
+		addr := modules.NetAddress(fmt.Sprintf("1.2.3.4:%d", i+1))
+		g.peers[addr] = &peer{Peer: modules.Peer{NetAddress: addr, Inbound: true}}
+	}
+
+	// A further connection from 1.2.3.4 should be closed without a handshake.
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	go g.threadedAcceptConn(fixedAddrConn{ours, "1.2.3.4:9999"})
+	theirs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := theirs.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected connection from a full host to be closed, got", err)
+	}
+
+	// A connection from a different host should proceed to the handshake.
+	ours, theirs = net.Pipe()
+	defer theirs.Close()
+	go g.threadedAcceptConn(fixedAddrConn{ours, "5.6.7.8:9999"})
+	theirs.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := connectVersionHandshake(theirs, build.Version); err != nil {
+		t.Fatal("expected connection from a different host to be accepted, got", err)
+	}
+}
+
 // TestConnect verifies that connecting peers will add peer relationships to
 // the gateway, and that certain edge cases are properly handled.
 func TestConnect(t *testing.T) {
@@ -428,6 +661,132 @@ func TestUnitAcceptableVersion(t *testing.T) {
 	}
 }
 
+// TestConnectRejectsOwnAddress checks that the gateway refuses to connect to
+// itself, including through aliases of its own address.
+func TestConnectRejectsOwnAddress(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	aliases := []modules.NetAddress{
+		g.Address(),
+		modules.NetAddress(net.JoinHostPort("127.0.0.2", g.port)),
+		modules.NetAddress(net.JoinHostPort("::1", g.port)),
+	}
+	g.mu.RLock()
+	for ip := range g.interfaceIPs {
+		aliases = append(aliases, modules.NetAddress(net.JoinHostPort(ip, g.port)))
+	}
+	g.mu.RUnlock()
+	for _, addr := range aliases {
+		if err := g.Connect(addr); err != errOurAddress {
+			t.Errorf("expected %v when connecting to %v, got %v", errOurAddress, addr, err)
+		}
+	}
+}
+
+// recordingDialer is a Dialer that records every address it is asked to dial
+// before dialing it directly.
+type recordingDialer struct {
+	mu     sync.Mutex
+	dialed []string
+}
+
+// Dial implements the Dialer interface.
+func (rd *recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	rd.mu.Lock()
+	rd.dialed = append(rd.dialed, addr)
+	rd.mu.Unlock()
+	return net.Dial(network, addr)
+}
+
+// TestConnectUsesDialer checks that outbound connections are routed through
+// the Dialer set with SetDialer.
+func TestConnectUsesDialer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	rd := new(recordingDialer)
+	g1.SetDialer(rd)
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if len(rd.dialed) != 1 || rd.dialed[0] != string(g2.Address()) {
+		t.Fatalf("expected the dialer to be used for %v, got %v", g2.Address(), rd.dialed)
+	}
+}
+
+// TestConnectCanonicalAddr checks that the exported methods treat different
+// spellings of a peer's IP as the same peer, so that a peer cannot be connected
+// to twice and bans cannot be bypassed.
+func TestConnectCanonicalAddr(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	// Spell g2's IPv4 address as an IPv4-mapped IPv6 address.
+	host, port, err := net.SplitHostPort(string(g2.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := modules.NetAddress(net.JoinHostPort("::ffff:"+host, port))
+	if mapped == g2.Address() || canonicalAddr(mapped) != g2.Address() {
+		t.Fatalf("%v is not an alias of %v", mapped, g2.Address())
+	}
+
+	if err := g1.Connect(mapped); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Connect(g2.Address()); err != errPeerExists {
+		t.Fatalf("expected %v, got %v", errPeerExists, err)
+	}
+	if peers := g1.Peers(); len(peers) != 1 || peers[0].NetAddress != g2.Address() {
+		t.Fatal("peer was not stored in canonical form:", peers)
+	}
+	if _, err := g1.NodeLastSeen(g2.Address()); err != nil {
+		t.Fatal("peer was not added to the node list:", err)
+	}
+	if _, err := g1.Ping(mapped); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Disconnect(mapped); err != nil {
+		t.Fatal(err)
+	}
+
+	// Banning one spelling bans every spelling.
+	if err := g1.Ban(mapped); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Connect(g2.Address()); err != errBannedHost {
+		t.Fatalf("expected %v, got %v", errBannedHost, err)
+	}
+	if err := g1.Unban(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Ban(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Connect(mapped); err != errBannedHost {
+		t.Fatalf("expected %v, got %v", errBannedHost, err)
+	}
+}
+
 // TestConnectRejectsInvalidAddrs tests that Connect only connects to valid IP
 // addresses.
 func TestConnectRejectsInvalidAddrs(t *testing.T) {
@@ -786,8 +1145,8 @@ func TestPeerManager(t *testing.T) {
 
 	// g1's node list should only contain g2
 	g1.mu.Lock()
-	g1.nodes = map[modules.NetAddress]struct{}{}
-	g1.nodes[g2.Address()] = struct{}{}
+	g1.nodes = map[modules.NetAddress]*node{}
+	g1.nodes[g2.Address()] = &node{lastSeen: time.Now()}
 	g1.mu.Unlock()
 
 	// when peerManager wakes up, it should connect to g2.
@@ -924,3 +1283,199 @@ func TestOverloadedBootstrap(t *testing.T) {
 		}
 	}
 }
+
+// TestPeerHealthCheck checks that the gateway disconnects from a peer that
+// stops responding to pings, while keeping responsive peers.
+func TestPeerHealthCheck(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a peer whose connection stays open, but which never responds.
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	go io.Copy(ioutil.Discard, theirs)
+	deadAddr := modules.NetAddress("1.2.3.4:5")
+	g1.mu.Lock()
+	g1.addPeer(&peer{
+		Peer: modules.Peer{
+			NetAddress: deadAddr,
+			Inbound:    true,
+		},
+		sess: muxado.Client(ours),
+	})
+	g1.mu.Unlock()
+
+	// The unresponsive peer should eventually be dropped.
+	dropped := false
+	for i := 0; i < 50 && !dropped; i++ {
+		time.Sleep(200 * time.Millisecond)
+		g1.mu.RLock()
+		_, exists := g1.peers[deadAddr]
+		g1.mu.RUnlock()
+		dropped = !exists
+	}
+	if !dropped {
+		t.Fatal("unresponsive peer was not dropped")
+	}
+	g1.mu.RLock()
+	_, exists := g1.peers[g2.Address()]
+	g1.mu.RUnlock()
+	if !exists {
+		t.Fatal("responsive peer was dropped")
+	}
+}
+
+// TestPeerHooks checks that the connect and disconnect hooks are called for
+// inbound and outbound peers.
+func TestPeerHooks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	connected := make(chan modules.NetAddress, 1)
+	disconnected := make(chan modules.NetAddress, 1)
+	g1.OnPeerConnect(func(addr modules.NetAddress) { connected <- addr })
+	g1.OnPeerDisconnect(func(addr modules.NetAddress) { disconnected <- addr })
+	inboundConnected := make(chan modules.NetAddress, 1)
+	g2.OnPeerConnect(func(addr modules.NetAddress) { inboundConnected <- addr })
+
+	// expect waits for an address on c.
+	expect := func(c chan modules.NetAddress, addr modules.NetAddress) {
+		select {
+		case got := <-c:
+			if got != addr {
+				t.Fatalf("hook called with %v, expected %v", got, addr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("hook was not called for", addr)
+		}
+	}
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	expect(connected, g2.Address())
+	expect(inboundConnected, g1.Address())
+	select {
+	case addr := <-disconnected:
+		t.Fatal("disconnect hook called while still connected to", addr)
+	default:
+	}
+
+	if err := g1.Disconnect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	expect(disconnected, g2.Address())
+}
+
+// TestBestPeer checks that BestPeer and WeightedRandomPeer favor the peers
+// with the lowest latency.
+func TestBestPeer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	// The gateway is built without its background threads, which would
+	// otherwise remove the fake peers.
+	g := &Gateway{peers: make(map[modules.NetAddress]*peer)}
+
+	if _, err := g.BestPeer(); err != errNoPeerLatencies {
+		t.Fatalf("expected %v, got %v", errNoPeerLatencies, err)
+	}
+
+	latencies := map[modules.NetAddress]time.Duration{
+		"1.1.1.1:1": 0, // never pinged
+		"2.2.2.2:2": 500 * time.Millisecond,
+		"3.3.3.3:3": 5 * time.Millisecond,
+		"4.4.4.4:4": 50 * time.Millisecond,
+	}
+	for addr, latency := range latencies {
+		g.peers[addr] = &peer{
+			Peer:    modules.Peer{NetAddress: addr},
+			latency: latency,
+		}
+	}
+
+	best, err := g.BestPeer()
+	if err != nil {
+		t.Fatal(err)
+	} else if best != "3.3.3.3:3" {
+		t.Fatal("expected the fastest peer, got", best)
+	}
+
+	counts := make(map[modules.NetAddress]int)
+	for i := 0; i < 1000; i++ {
+		addr, err := g.WeightedRandomPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[addr]++
+	}
+	if counts["1.1.1.1:1"] != 0 {
+		t.Error("WeightedRandomPeer selected a peer with no measured latency")
+	}
+	if counts["3.3.3.3:3"] <= counts["4.4.4.4:4"] || counts["4.4.4.4:4"] <= counts["2.2.2.2:2"] {
+		t.Error("WeightedRandomPeer did not favor faster peers:", counts)
+	}
+}
+
+// TestPeersByLatency checks that PeersByLatency orders peers by measured
+// latency, followed by unmeasured peers ordered by when they were last seen.
+func TestPeersByLatency(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	// The gateway is built without its background threads, which would
+	// otherwise remove the fake peers.
+	g := &Gateway{
+		peers: make(map[modules.NetAddress]*peer),
+		nodes: make(map[modules.NetAddress]*node),
+	}
+
+	now := time.Now()
+	peers := []struct {
+		addr     modules.NetAddress
+		latency  time.Duration
+		lastSeen time.Time
+	}{
+		{"1.1.1.1:1", 0, now.Add(-time.Hour)},
+		{"2.2.2.2:2", 500 * time.Millisecond, now},
+		{"3.3.3.3:3", 5 * time.Millisecond, now},
+		{"4.4.4.4:4", 0, now},
+		{"5.5.5.5:5", 50 * time.Millisecond, now},
+	}
+	for _, p := range peers {
+		g.peers[p.addr] = &peer{
+			Peer:    modules.Peer{NetAddress: p.addr},
+			latency: p.latency,
+		}
+		g.nodes[p.addr] = &node{lastSeen: p.lastSeen}
+	}
+
+	expected := []modules.NetAddress{"3.3.3.3:3", "5.5.5.5:5", "2.2.2.2:2", "4.4.4.4:4", "1.1.1.1:1"}
+	sorted := g.PeersByLatency()
+	if len(sorted) != len(expected) {
+		t.Fatalf("expected %v peers, got %v", len(expected), len(sorted))
+	}
+	for i, p := range sorted {
+		if p.NetAddress != expected[i] {
+			t.Fatalf("expected %v at position %v, got %v", expected[i], i, p.NetAddress)
+		}
+	}
+}
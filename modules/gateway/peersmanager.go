@@ -1,6 +1,9 @@
 package gateway
 
 import (
+	"io"
+	"sync"
+
 	"github.com/NebulousLabs/Sia/build"
 	"github.com/NebulousLabs/Sia/modules"
 )
@@ -141,3 +144,83 @@ func (g *Gateway) permanentPeerManager(closedChan chan struct{}) {
 		}
 	}
 }
+
+// managedCheckPeerHealth pings a peer and disconnects from it if it has failed
+// maxPeerPingFailures pings in a row. A peer older than pingUpgradeVersion
+// closes the stream without responding, but is alive, so it is not penalized.
+// Newer peers must echo the nonce.
+func (g *Gateway) managedCheckPeerHealth(addr modules.NetAddress) {
+	g.mu.RLock()
+	p, exists := g.peers[addr]
+	var version string
+	if exists {
+		version = p.Version
+	}
+	g.mu.RUnlock()
+	if !exists {
+		return
+	}
+	_, err := g.managedPing(addr)
+	predatesPing := build.VersionCmp(version, pingUpgradeVersion) < 0
+	alive := err == nil || (err == io.EOF && predatesPing)
+
+	g.mu.Lock()
+	p, exists = g.peers[addr]
+	if !exists {
+		g.mu.Unlock()
+		return
+	}
+	if alive {
+		p.pingFailures = 0
+		g.markNodeSeen(addr)
+		g.mu.Unlock()
+		return
+	}
+	p.pingFailures++
+	if p.pingFailures < maxPeerPingFailures {
+		g.mu.Unlock()
+		return
+	}
+	delete(g.peers, addr)
+	// Remove the node, but only if there are enough nodes in the node list.
+	if len(g.nodes) > pruneNodeListLen {
+		g.removeNode(addr)
+	}
+	g.mu.Unlock()
+
+	g.log.Debugf("INFO: disconnecting from peer %v after %v failed pings: %v", addr, maxPeerPingFailures, err)
+	if err := p.sess.Close(); err != nil {
+		g.log.Debugf("WARN: error disconnecting from peer %q: %v", addr, err)
+	}
+}
+
+// permanentPeerHealthChecker periodically pings every peer, disconnecting
+// peers that have stopped responding. Peers whose connection closes are
+// removed by threadedListenPeer, but a peer that disappears without closing
+// the connection would otherwise be kept forever.
+func (g *Gateway) permanentPeerHealthChecker(closeChan chan struct{}) {
+	defer close(closeChan)
+
+	for {
+		if !g.managedSleep(peerHealthCheckInterval) {
+			return
+		}
+
+		g.mu.RLock()
+		addrs := make([]modules.NetAddress, 0, len(g.peers))
+		for addr := range g.peers {
+			addrs = append(addrs, addr)
+		}
+		g.mu.RUnlock()
+
+		var wg sync.WaitGroup
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(addr modules.NetAddress) {
+				defer wg.Done()
+				g.managedCheckPeerHealth(addr)
+			}(addr)
+		}
+		wg.Wait()
+	}
+}
@@ -17,40 +17,95 @@ const (
 )
 
 // persistMetadata contains the header and version strings that identify the
-// gateway persist file.
+// gateway persist file. The version is the release that introduced the current
+// format, so it is never newer than build.Version.
 var persistMetadata = persist.Metadata{
+	Header:  "Sia Node List",
+	Version: "1.3.0",
+}
+
+// compat033Metadata identifies gateway persist files from before v1.3.0,
+// which only contain the addresses of the nodes.
+var compat033Metadata = persist.Metadata{
 	Header:  "Sia Node List",
 	Version: "0.3.3",
 }
 
+// persistNode is a node as it is saved to disk.
+type persistNode struct {
+	NetAddress modules.NetAddress `json:"netaddress"`
+	LastSeen   time.Time          `json:"lastseen"`
+	Verified   bool               `json:"verified"`
+}
+
 // persistData returns the data in the Gateway that will be saved to disk.
-func (g *Gateway) persistData() (nodes []modules.NetAddress) {
-	for node := range g.nodes {
-		nodes = append(nodes, node)
+func (g *Gateway) persistData() (nodes []persistNode) {
+	for addr, n := range g.nodes {
+		nodes = append(nodes, persistNode{
+			NetAddress: addr,
+			LastSeen:   n.lastSeen,
+			Verified:   n.verified,
+		})
 	}
 	return
 }
 
-// load loads the Gateway's persistent data from disk.
+// load loads the Gateway's persistent data from disk. Nodes keep the lastSeen
+// time and verified flag that they were saved with, so that nodes which stay
+// offline across restarts still expire, and verified nodes stay protected from
+// eviction.
 func (g *Gateway) load() error {
-	var nodes []modules.NetAddress
+	var nodes []persistNode
 	err := persist.LoadJSON(persistMetadata, &nodes, filepath.Join(g.persistDir, nodesFile))
+	if err == persist.ErrBadVersion {
+		nodes, err = g.loadCompat033()
+	}
 	if err != nil {
 		return err
 	}
 	for _, node := range nodes {
-		err := g.addNode(node)
+		err := g.addNode(node.NetAddress)
 		if err != nil {
-			g.log.Printf("WARN: error loading node '%v' from persist: %v", node, err)
+			g.log.Printf("WARN: error loading node '%v' from persist: %v", node.NetAddress, err)
+			continue
+		}
+		n := g.nodes[canonicalAddr(node.NetAddress)]
+		if !node.LastSeen.IsZero() {
+			n.lastSeen = node.LastSeen
 		}
+		n.verified = node.Verified
 	}
 	return nil
 }
 
-// saveSync stores the Gateway's persistent data on disk, and then syncs to
-// disk to minimize the possibility of data loss.
-func (g *Gateway) saveSync() error {
-	return persist.SaveJSON(persistMetadata, g.persistData(), filepath.Join(g.persistDir, nodesFile))
+// loadCompat033 loads a persist file from before v1.3.0. The nodes in the file
+// have no lastSeen time, so they are treated as having been seen when they are
+// loaded.
+func (g *Gateway) loadCompat033() ([]persistNode, error) {
+	var addrs []modules.NetAddress
+	err := persist.LoadJSON(compat033Metadata, &addrs, filepath.Join(g.persistDir, nodesFile))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]persistNode, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = persistNode{NetAddress: addr}
+	}
+	return nodes, nil
+}
+
+// managedSaveSync stores the Gateway's persistent data on disk, and then syncs
+// to disk to minimize the possibility of data loss. The gateway lock is only
+// held while the data is collected, not while it is written, so that a slow
+// disk does not hold up peer connections and RPCs.
+func (g *Gateway) managedSaveSync() error {
+	g.persistMu.Lock()
+	defer g.persistMu.Unlock()
+
+	g.mu.RLock()
+	data := g.persistData()
+	g.mu.RUnlock()
+	return persist.SaveJSON(persistMetadata, data, filepath.Join(g.persistDir, nodesFile))
 }
 
 // threadedSaveLoop periodically saves the gateway.
@@ -69,9 +124,7 @@ func (g *Gateway) threadedSaveLoop() {
 			}
 			defer g.threads.Done()
 
-			g.mu.Lock()
-			err = g.saveSync()
-			g.mu.Unlock()
+			err = g.managedSaveSync()
 			if err != nil {
 				g.log.Println("ERROR: Unable to save gateway persist:", err)
 			}
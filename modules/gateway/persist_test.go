@@ -1,7 +1,14 @@
 package gateway
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/build"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/persist"
 )
 
 func TestLoad(t *testing.T) {
@@ -11,17 +18,71 @@ func TestLoad(t *testing.T) {
 	t.Parallel()
 	g := newTestingGateway(t)
 
+	lastSeen := time.Now().Add(-time.Hour).Round(time.Second)
 	g.mu.Lock()
 	g.addNode(dummyNode)
-	g.saveSync()
+	g.nodes[dummyNode].lastSeen = lastSeen
+	g.nodes[dummyNode].verified = true
 	g.mu.Unlock()
+	g.managedSaveSync()
 	g.Close()
 
 	g2, err := New("localhost:0", false, g.persistDir)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer g2.Close()
 	if _, ok := g2.nodes[dummyNode]; !ok {
 		t.Fatal("gateway did not load old peer list:", g2.nodes)
 	}
+	seen, err := g2.NodeLastSeen(dummyNode)
+	if err != nil {
+		t.Fatal(err)
+	} else if !seen.Equal(lastSeen) {
+		t.Fatalf("node was loaded with lastSeen %v, expected %v", seen, lastSeen)
+	}
+	g2.mu.RLock()
+	verified := g2.nodes[dummyNode].verified
+	g2.mu.RUnlock()
+	if !verified {
+		t.Fatal("node was not loaded as verified")
+	}
+}
+
+// TestPersistVersion checks that the persist file is not versioned after the
+// release that writes it.
+func TestPersistVersion(t *testing.T) {
+	if build.VersionCmp(persistMetadata.Version, build.Version) > 0 {
+		t.Fatalf("persist version %v is newer than the release version %v", persistMetadata.Version, build.Version)
+	}
+}
+
+// TestLoadCompat033 checks that a node list saved in the pre-v1.3.0 format,
+// which only contains addresses, can be loaded.
+func TestLoadCompat033(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	dir := build.TempDir("gateway", t.Name())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	err := persist.SaveJSON(compat033Metadata, []modules.NetAddress{dummyNode}, filepath.Join(dir, nodesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	g, err := New("localhost:0", false, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	seen, err := g.NodeLastSeen(dummyNode)
+	if err != nil {
+		t.Fatal("gateway did not load old peer list:", err)
+	} else if seen.Before(start) {
+		t.Fatalf("node was loaded with lastSeen %v, expected the time it was loaded", seen)
+	}
 }
@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"errors"
+	"time"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/fastrand"
+)
+
+// pingNonceSize is the size of the nonce that the caller of the Ping RPC
+// sends and the receiver echoes back.
+const pingNonceSize = 8
+
+var errBadPong = errors.New("peer responded to ping with an invalid pong")
+
+// pong is the receiving end of the Ping RPC. It echoes the caller's nonce so
+// that the caller can confirm that the peer is responsive.
+func (g *Gateway) pong(conn modules.PeerConn) error {
+	var nonce [pingNonceSize]byte
+	if err := encoding.ReadObject(conn, &nonce, pingNonceSize); err != nil {
+		return err
+	}
+	return encoding.WriteObject(conn, nonce)
+}
+
+// managedPing calls the Ping RPC on a connected peer and returns the round
+// trip time of the call, which is also recorded as the peer's latency.
+func (g *Gateway) managedPing(addr modules.NetAddress) (time.Duration, error) {
+	start := time.Now()
+	err := g.managedRPC(addr, "Ping", func(conn modules.PeerConn) error {
+		conn.SetDeadline(time.Now().Add(pingTimeout))
+		var nonce, resp [pingNonceSize]byte
+		fastrand.Read(nonce[:])
+		if err := encoding.WriteObject(conn, nonce); err != nil {
+			return err
+		}
+		if err := encoding.ReadObject(conn, &resp, pingNonceSize); err != nil {
+			return err
+		}
+		if resp != nonce {
+			return errBadPong
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	// Record the latency for peer selection.
+	g.mu.Lock()
+	if p, exists := g.peers[addr]; exists {
+		p.latency = rtt
+	}
+	g.mu.Unlock()
+	return rtt, nil
+}
+
+// Ping calls the Ping RPC on a connected peer, returning the round trip time
+// if the peer echoes back the random nonce that was sent to it. Peers that
+// predate the Ping RPC will close the stream without responding, resulting in
+// an error.
+func (g *Gateway) Ping(addr modules.NetAddress) (time.Duration, error) {
+	if err := g.threads.Add(); err != nil {
+		return 0, err
+	}
+	defer g.threads.Done()
+	return g.managedPing(addr)
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/muxado"
+)
+
+// TestPing checks that a gateway can ping a connected peer and measure the
+// round trip time, and that pinging an unconnected address fails.
+func TestPing(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	// Pinging a gateway that is not a peer should fail.
+	if _, err := g1.Ping(g2.Address()); err == nil {
+		t.Fatal("expected ping of unconnected gateway to fail")
+	}
+
+	err := g1.Connect(g2.Address())
+	if err != nil {
+		t.Fatal("failed to connect:", err)
+	}
+	rtt, err := g1.Ping(g2.Address())
+	if err != nil {
+		t.Fatal(err)
+	} else if rtt <= 0 {
+		t.Fatal("expected a positive round trip time, got", rtt)
+	}
+}
+
+// TestPingWrongNonce checks that a pong that does not echo the nonce is
+// treated as a failure.
+func TestPingWrongNonce(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	// Replace g2's Ping handler with one that responds with a different
+	// nonce.
+	g2.UnregisterRPC("Ping")
+	g2.RegisterRPC("Ping", func(conn modules.PeerConn) error {
+		var nonce [pingNonceSize]byte
+		if err := encoding.ReadObject(conn, &nonce, pingNonceSize); err != nil {
+			return err
+		}
+		nonce[0]++
+		return encoding.WriteObject(conn, nonce)
+	})
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g1.Ping(g2.Address()); err != errBadPong {
+		t.Fatalf("expected %v, got %v", errBadPong, err)
+	}
+}
+
+// TestPeerHealthCheckSilentPeer checks that a peer which closes the Ping
+// stream without responding is only considered alive if its version predates
+// the Ping RPC.
+func TestPeerHealthCheckSilentPeer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	// oldPeer completes the handshake as a peer that predates the Ping RPC,
+	// and, like such a peer, closes every stream after reading the RPC name
+	// because it has no handler for it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := acceptConnVersionHandshake(conn, "1.2.0"); err != nil {
+			return
+		}
+		if _, err := acceptConnPortHandshake(conn); err != nil {
+			return
+		}
+		sess := muxado.Server(conn)
+		for {
+			stream, err := sess.Accept()
+			if err != nil {
+				return
+			}
+			var id rpcID
+			encoding.ReadObject(stream, &id, 8)
+			stream.Close()
+		}
+	}()
+	oldPeer := modules.NetAddress(l.Addr().String())
+
+	// Replace g2's Ping handler with one that closes the stream without
+	// responding. g2 runs the current version, so it should answer.
+	g2.UnregisterRPC("Ping")
+	g2.RegisterRPC("Ping", func(conn modules.PeerConn) error {
+		return nil
+	})
+
+	if err := g1.Connect(oldPeer); err != nil {
+		t.Fatal(err)
+	}
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	peerExists := func(addr modules.NetAddress) bool {
+		g1.mu.RLock()
+		defer g1.mu.RUnlock()
+		_, exists := g1.peers[addr]
+		return exists
+	}
+
+	for i := 0; i < 50 && peerExists(g2.Address()); i++ {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if peerExists(g2.Address()) {
+		t.Fatal("peer that closed the Ping stream was not dropped")
+	}
+	if !peerExists(oldPeer) {
+		t.Fatal("peer that predates the Ping RPC was dropped")
+	}
+}
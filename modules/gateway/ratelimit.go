@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the combined throughput of every connection that shares
+// it. Each transfer reserves its bytes against the limit, and a transfer has
+// to wait until the bytes reserved before it would have been sent at the
+// configured rate.
+type rateLimiter struct {
+	bytesPerSecond int64
+	next           time.Time
+	mu             sync.Mutex
+}
+
+// setLimit sets the limit in bytes per second. A limit of 0 disables rate
+// limiting.
+func (rl *rateLimiter) setLimit(bytesPerSecond int64) {
+	rl.mu.Lock()
+	rl.bytesPerSecond = bytesPerSecond
+	rl.next = time.Time{}
+	rl.mu.Unlock()
+}
+
+// wait reserves n bytes and blocks until the previously reserved bytes have
+// been transferred at the configured rate, or until cancel is closed.
+func (rl *rateLimiter) wait(n int, cancel <-chan struct{}) {
+	rl.mu.Lock()
+	if rl.bytesPerSecond <= 0 {
+		rl.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(n) * time.Second / time.Duration(rl.bytesPerSecond))
+	rl.mu.Unlock()
+
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-cancel:
+	}
+}
+
+// SetRateLimits limits the combined download and upload speed, in bytes per
+// second, of all of the gateway's peer connections. A limit of 0 means
+// unlimited. Limits are not persisted across restarts.
+func (g *Gateway) SetRateLimits(downloadSpeed, uploadSpeed int64) error {
+	if err := g.threads.Add(); err != nil {
+		return err
+	}
+	defer g.threads.Done()
+
+	g.readLimiter.setLimit(downloadSpeed)
+	g.writeLimiter.setLimit(uploadSpeed)
+	return nil
+}
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRateLimits checks that writes through a gateway connection are slowed
+// down to the configured upload speed.
+func TestRateLimits(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	// transfer writes 20e3 bytes through a gateway connection and returns how
+	// long it took.
+	transfer := func() time.Duration {
+		ours, theirs := net.Pipe()
+		defer ours.Close()
+		go io.Copy(ioutil.Discard, theirs)
+		conn := meteredConn{Conn: ours, g: g}
+		chunk := make([]byte, 1e3)
+		start := time.Now()
+		for i := 0; i < 20; i++ {
+			if _, err := conn.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return time.Since(start)
+	}
+
+	// Without a limit the transfer should be near instant.
+	if elapsed := transfer(); elapsed > time.Second {
+		t.Fatal("unlimited transfer took", elapsed)
+	}
+
+	// At 10e3 bytes per second the transfer should take about 2 seconds. The
+	// first chunk is sent without waiting.
+	if err := g.SetRateLimits(0, 10e3); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := transfer(); elapsed < 1800*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatal("expected the limited transfer to take about 2 seconds, took", elapsed)
+	}
+
+	// Removing the limit should restore full speed.
+	if err := g.SetRateLimits(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := transfer(); elapsed > time.Second {
+		t.Fatal("unlimited transfer took", elapsed)
+	}
+}
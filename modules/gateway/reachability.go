@@ -0,0 +1,57 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/fastrand"
+)
+
+// dialBack is the receiving end of the DialBack RPC. It tries to connect to
+// the caller's dialback address and reports whether it succeeded. Only the
+// caller's own address is ever dialed, so the RPC cannot be used to direct
+// traffic at third parties.
+func (g *Gateway) dialBack(conn modules.PeerConn) error {
+	conn.SetDeadline(time.Now().Add(connStdDeadline))
+	err := g.pingNode(conn.RPCAddr())
+	if err != nil {
+		g.log.Debugf("INFO: could not dial back %v: %v", conn.RPCAddr(), err)
+	}
+	return encoding.WriteObject(conn, err == nil)
+}
+
+// managedIsReachable asks a random peer to dial the gateway back at the
+// address that the peer knows it by.
+func (g *Gateway) managedIsReachable() (bool, error) {
+	g.mu.RLock()
+	addrs := make([]modules.NetAddress, 0, len(g.peers))
+	for addr := range g.peers {
+		addrs = append(addrs, addr)
+	}
+	g.mu.RUnlock()
+	if len(addrs) == 0 {
+		return false, errNoPeers
+	}
+
+	var reachable bool
+	err := g.managedRPC(addrs[fastrand.Intn(len(addrs))], "DialBack", func(conn modules.PeerConn) error {
+		conn.SetDeadline(time.Now().Add(connStdDeadline))
+		return encoding.ReadObject(conn, &reachable, 1)
+	})
+	return reachable, err
+}
+
+// IsReachable reports whether other nodes can open connections to the
+// gateway, by asking a random peer to dial it back. A gateway behind a NAT or
+// firewall that does not forward its port can still connect to peers, but is
+// not reachable, so other nodes will never add it to their node list. Peers
+// that predate the DialBack RPC will close the stream without responding,
+// resulting in an error.
+func (g *Gateway) IsReachable() (bool, error) {
+	if err := g.threads.Add(); err != nil {
+		return false, err
+	}
+	defer g.threads.Done()
+	return g.managedIsReachable()
+}
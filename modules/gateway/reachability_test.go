@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"testing"
+)
+
+// TestIsReachable checks that a peer can confirm whether the gateway accepts
+// incoming connections.
+func TestIsReachable(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	if _, err := g1.IsReachable(); err != errNoPeers {
+		t.Fatalf("expected %v, got %v", errNoPeers, err)
+	}
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	reachable, err := g1.IsReachable()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reachable {
+		t.Fatal("gateway should be reachable")
+	}
+
+	// Once g1 stops listening, g2 should no longer be able to dial it.
+	if err := g1.listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reachable, err = g1.IsReachable()
+	if err != nil {
+		t.Fatal(err)
+	} else if reachable {
+		t.Fatal("gateway should not be reachable after closing its listener")
+	}
+}
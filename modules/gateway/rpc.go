@@ -2,7 +2,11 @@ package gateway
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NebulousLabs/Sia/build"
@@ -37,13 +41,18 @@ func handlerName(name string) (id rpcID) {
 // an address that the Gateway is not connected to.
 func (g *Gateway) managedRPC(addr modules.NetAddress, name string, fn modules.RPCFunc) error {
 	g.mu.RLock()
-	peer, ok := g.peers[addr]
+	peer, ok := g.peers[canonicalAddr(addr)]
 	g.mu.RUnlock()
 	if !ok {
 		return errors.New("can't call RPC on unconnected peer " + string(addr))
 	}
+	return callRPC(peer, name, fn)
+}
 
-	conn, err := peer.open()
+// callRPC calls an RPC on a peer. Unlike managedRPC, the peer does not need to
+// be in the Gateway's peer list.
+func callRPC(p *peer, name string, fn modules.RPCFunc) error {
+	conn, err := p.open()
 	if err != nil {
 		return err
 	}
@@ -72,6 +81,10 @@ func (g *Gateway) RPC(addr modules.NetAddress, name string, fn modules.RPCFunc)
 // RegisterRPC. Identifiers should always use PascalCase. The first 8
 // characters of an identifier should be unique, as the identifier used
 // internally is truncated to 8 bytes.
+//
+// In release builds, a panic in fn is recovered and only closes the stream,
+// but fn must not panic while holding a lock, as the lock stays locked. Debug
+// builds do not recover.
 func (g *Gateway) RegisterRPC(name string, fn modules.RPCFunc) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -92,6 +105,19 @@ func (g *Gateway) UnregisterRPC(name string) {
 	delete(g.handlers, handlerName(name))
 }
 
+// RegisteredRPCs returns the identifiers of all registered RPCs in sorted
+// order. Identifiers are truncated to 8 bytes, as they are on the wire.
+func (g *Gateway) RegisteredRPCs() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	names := make([]string, 0, len(g.handlers))
+	for id := range g.handlers {
+		names = append(names, strings.TrimSpace(id.String()))
+	}
+	sort.Strings(names)
+	return names
+}
+
 // RegisterConnectCall registers a name and RPCFunc to be called on a peer
 // upon connecting.
 func (g *Gateway) RegisterConnectCall(name string, fn modules.RPCFunc) {
@@ -131,6 +157,11 @@ func (g *Gateway) threadedListenPeer(p *peer) {
 	}
 	defer g.peerTG.Done()
 
+	// Let subscribers know about the peer for as long as the connection
+	// lasts.
+	g.managedPeerConnected(p.NetAddress)
+	defer g.managedPeerDisconnected(p.NetAddress)
+
 	// Spin up a goroutine to listen for a shutdown signal from both the peer
 	// and from the gateway. In the event of either, close the muxado session.
 	connClosedChan := make(chan struct{})
@@ -190,6 +221,8 @@ func (g *Gateway) threadedHandleConn(conn modules.PeerConn) {
 		return
 	}
 	defer g.threads.Done()
+	atomic.AddUint64(&g.atomicActiveRPCs, 1)
+	defer atomic.AddUint64(&g.atomicActiveRPCs, ^uint64(0))
 
 	var id rpcID
 	err := conn.SetDeadline(time.Now().Add(rpcStdDeadline))
@@ -204,10 +237,27 @@ func (g *Gateway) threadedHandleConn(conn modules.PeerConn) {
 	fn, ok := g.handlers[id]
 	g.mu.RUnlock()
 	if !ok {
+		atomic.AddUint64(&g.atomicUnknownRPCCalls, 1)
 		g.log.Debugf("WARN: incoming conn %v requested unknown RPC \"%v\"", conn.RPCAddr(), id)
 		return
 	}
 	g.log.Debugf("INFO: incoming conn %v requested RPC \"%v\"", conn.RPCAddr(), id)
+	g.rpcCallsMu.Lock()
+	g.rpcCalls[id]++
+	g.rpcCallsMu.Unlock()
+
+	// Recover from panics in the handler so that a single misbehaving RPC
+	// cannot take down the whole node. Debug builds crash instead, as the
+	// panic may come from a failed sanity check and any locks held by the
+	// handler are left locked.
+	defer func() {
+		if r := recover(); r != nil {
+			if build.DEBUG {
+				panic(r)
+			}
+			g.log.Critical(fmt.Sprintf("incoming RPC \"%v\" from conn %v panicked: %v", id, conn.RPCAddr(), r))
+		}
+	}()
 
 	// call fn
 	err = fn(conn)
@@ -220,16 +270,11 @@ func (g *Gateway) threadedHandleConn(conn modules.PeerConn) {
 	}
 }
 
-// Broadcast calls an RPC on all of the specified peers. The calls are run in
-// parallel. Broadcasts are restricted to "one-way" RPCs, which simply write an
-// object and disconnect. This is why Broadcast takes an interface{} instead of
-// an RPCFunc.
-func (g *Gateway) Broadcast(name string, obj interface{}, peers []modules.Peer) {
-	if g.threads.Add() != nil {
-		return
-	}
-	defer g.threads.Done()
-
+// managedBroadcast calls an RPC on all of the specified peers in parallel, at
+// most maxConcurrentBroadcasts at a time. A peer that fails is retried once
+// after broadcastRetryDelay. The final error for every peer that could not be
+// reached is returned, keyed by address.
+func (g *Gateway) managedBroadcast(name string, obj interface{}, peers []modules.Peer) map[modules.NetAddress]error {
 	g.log.Debugf("INFO: broadcasting RPC %q to %v peers", name, len(peers))
 
 	// only encode obj once, instead of using WriteObject
@@ -238,26 +283,69 @@ func (g *Gateway) Broadcast(name string, obj interface{}, peers []modules.Peer)
 		return encoding.WritePrefix(conn, enc)
 	}
 
+	var errsMu sync.Mutex
+	errs := make(map[modules.NetAddress]error)
 	var wg sync.WaitGroup
+	// Limit the number of peers that are called at once. A slot is taken
+	// before spawning each goroutine and released as soon as its call
+	// completes. A peer that failed gives up its slot while it waits to be
+	// retried, so that failing peers do not hold up the healthy ones.
+	limiterChan := make(chan struct{}, maxConcurrentBroadcasts)
 	for _, p := range peers {
 		wg.Add(1)
+		limiterChan <- struct{}{}
 		go func(addr modules.NetAddress) {
 			defer wg.Done()
 			err := g.managedRPC(addr, name, fn)
+			<-limiterChan
 			if err != nil {
-				g.log.Debugf("WARN: broadcasting RPC %q to peer %q failed (attempting again in 10 seconds): %v", name, addr, err)
+				g.log.Debugf("WARN: broadcasting RPC %q to peer %q failed (attempting again in %v): %v", name, addr, broadcastRetryDelay, err)
 				// try one more time before giving up
 				select {
-				case <-time.After(10 * time.Second):
+				case <-time.After(broadcastRetryDelay):
+					limiterChan <- struct{}{}
+					err = g.managedRPC(addr, name, fn)
+					<-limiterChan
+					if err != nil {
+						g.log.Debugf("WARN: broadcasting RPC %q to peer %q failed twice: %v", name, addr, err)
+					}
 				case <-g.threads.StopChan():
-					return
-				}
-				err := g.managedRPC(addr, name, fn)
-				if err != nil {
-					g.log.Debugf("WARN: broadcasting RPC %q to peer %q failed twice: %v", name, addr, err)
 				}
 			}
+			if err != nil {
+				errsMu.Lock()
+				errs[addr] = err
+				errsMu.Unlock()
+			}
 		}(p.NetAddress)
 	}
 	wg.Wait()
+	return errs
+}
+
+// Broadcast calls an RPC on all of the specified peers. The calls are run in
+// parallel. Broadcasts are restricted to "one-way" RPCs, which simply write an
+// object and disconnect. This is why Broadcast takes an interface{} instead of
+// an RPCFunc.
+func (g *Gateway) Broadcast(name string, obj interface{}, peers []modules.Peer) {
+	if g.threads.Add() != nil {
+		return
+	}
+	defer g.threads.Done()
+	g.managedBroadcast(name, obj, peers)
+}
+
+// BroadcastErrors is like Broadcast, but blocks until every call has completed
+// and returns the error for each peer that could not be reached, keyed by
+// address. Peers that received the object do not appear in the map.
+func (g *Gateway) BroadcastErrors(name string, obj interface{}, peers []modules.Peer) map[modules.NetAddress]error {
+	if err := g.threads.Add(); err != nil {
+		errs := make(map[modules.NetAddress]error, len(peers))
+		for _, p := range peers {
+			errs[p.NetAddress] = err
+		}
+		return errs
+	}
+	defer g.threads.Done()
+	return g.managedBroadcast(name, obj, peers)
 }
@@ -2,12 +2,15 @@ package gateway
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/NebulousLabs/Sia/build"
 	"github.com/NebulousLabs/Sia/encoding"
 	"github.com/NebulousLabs/Sia/modules"
 )
@@ -102,6 +105,37 @@ func TestUnregisterRPC(t *testing.T) {
 	g1.UnregisterRPC("Foo")
 }
 
+// TestRegisteredRPCs checks that RegisteredRPCs reflects registering and
+// unregistering RPCs.
+func TestRegisteredRPCs(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	isRegistered := func(name string) bool {
+		for _, n := range g.RegisteredRPCs() {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	if !isRegistered("ShareNod") {
+		t.Error("RegisteredRPCs is missing the ShareNodes RPC:", g.RegisteredRPCs())
+	}
+	g.RegisterRPC("Foo", func(conn modules.PeerConn) error { return nil })
+	if !isRegistered("Foo") {
+		t.Error("RegisteredRPCs is missing a newly registered RPC:", g.RegisteredRPCs())
+	}
+	g.UnregisterRPC("Foo")
+	if isRegistered("Foo") {
+		t.Error("RegisteredRPCs still lists an unregistered RPC:", g.RegisteredRPCs())
+	}
+}
+
 // TestRegisterConnectCall tests that registering the same on-connect call
 // twice causes a panic.
 func TestRegisterConnectCall(t *testing.T) {
@@ -312,6 +346,181 @@ func TestThreadedHandleConn(t *testing.T) {
 	}
 }
 
+// TestActiveRPCs checks that the gateway reports the number of incoming RPCs
+// being handled, and that the count returns to zero once they finish.
+func TestActiveRPCs(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal("failed to connect:", err)
+	}
+
+	release := make(chan struct{})
+	g2.RegisterRPC("Block", func(conn modules.PeerConn) error {
+		<-release
+		return nil
+	})
+	const numRPCs = 3
+	for i := 0; i < numRPCs; i++ {
+		err := g1.RPC(g2.Address(), "Block", func(conn modules.PeerConn) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// waitActive waits for the number of active RPCs on g2 to satisfy fn.
+	waitActive := func(fn func(uint64) bool) uint64 {
+		var n uint64
+		for i := 0; i < 100; i++ {
+			n = g2.NetworkMetrics().ActiveRPCs
+			if fn(n) {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return n
+	}
+	if n := waitActive(func(n uint64) bool { return n >= numRPCs }); n < numRPCs {
+		t.Fatalf("expected at least %v active RPCs, got %v", numRPCs, n)
+	}
+	close(release)
+	if n := waitActive(func(n uint64) bool { return n == 0 }); n != 0 {
+		t.Fatal("expected no active RPCs after the handlers returned, got", n)
+	}
+}
+
+// TestUnknownRPC checks that calls to RPCs without a handler are counted and
+// that the connection is closed without a response.
+func TestUnknownRPC(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal("failed to connect:", err)
+	}
+
+	err := g1.RPC(g2.Address(), "Unknown", func(conn modules.PeerConn) error {
+		var resp string
+		return encoding.ReadObject(conn, &resp, 8)
+	})
+	if err != io.EOF {
+		t.Fatal("expected EOF from unknown RPC, got", err)
+	}
+
+	// The counter is updated before the connection is closed, so it must be
+	// visible by now.
+	m := g2.NetworkMetrics()
+	if m.UnknownRPCCalls != 1 {
+		t.Fatal("expected 1 unknown RPC call, got", m.UnknownRPCCalls)
+	}
+	if _, ok := m.RPCCalls["Unknown"]; ok {
+		t.Fatal("unknown RPC was counted as a registered RPC")
+	}
+}
+
+// TestThreadedHandleConnDeadline checks that a peer which opens a stream and
+// then stalls partway through the RPC header is disconnected once the standard
+// RPC deadline elapses, instead of holding the handler thread forever.
+func TestThreadedHandleConnDeadline(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	err := g1.Connect(g2.Address())
+	if err != nil {
+		t.Fatal("failed to connect:", err)
+	}
+
+	// Open a stream and write only part of the rpcID prefix.
+	g1.mu.RLock()
+	p := g1.peers[g2.Address()]
+	g1.mu.RUnlock()
+	conn, err := p.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// g2 should give up on the stream once the deadline passes.
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the stalled stream to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > rpcStdDeadline+2*time.Second {
+		t.Fatalf("stalled stream was held open for %v", elapsed)
+	}
+}
+
+// TestThreadedHandleConnPanic checks that, in release builds, a panicking RPC
+// handler does not crash the gateway, and that the gateway continues to serve
+// RPCs afterwards.
+func TestThreadedHandleConnPanic(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	if build.DEBUG {
+		t.Skip("handler panics are not recovered in debug builds")
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	err := g1.Connect(g2.Address())
+	if err != nil {
+		t.Fatal("failed to connect:", err)
+	}
+
+	g2.RegisterRPC("Panic", func(conn modules.PeerConn) error {
+		panic("handler panic")
+	})
+	g2.RegisterRPC("Foo", func(conn modules.PeerConn) error {
+		return encoding.WriteObject(conn, "foo")
+	})
+
+	// The panicking handler should close the stream without a response.
+	err = g1.RPC(g2.Address(), "Panic", func(conn modules.PeerConn) error {
+		var s string
+		return encoding.ReadObject(conn, &s, 100)
+	})
+	if err == nil {
+		t.Fatal("expected an error from the panicking RPC")
+	}
+
+	// The gateway should still be serving RPCs.
+	var foo string
+	err = g1.RPC(g2.Address(), "Foo", func(conn modules.PeerConn) error {
+		return encoding.ReadObject(conn, &foo, 100)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if foo != "foo" {
+		t.Fatalf("expected \"foo\", got %q", foo)
+	}
+}
+
 // TestBroadcast tests that calling broadcast with a slice of peers only
 // broadcasts to those peers.
 func TestBroadcast(t *testing.T) {
@@ -436,6 +645,106 @@ func TestBroadcast(t *testing.T) {
 	}
 }
 
+// TestBroadcastErrors checks that BroadcastErrors reports an error for every
+// peer that could not be reached, and no error for peers that were.
+func TestBroadcastErrors(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	err := g1.Connect(g2.Address())
+	if err != nil {
+		t.Fatal("failed to connect:", err)
+	}
+	recvChan := make(chan string, 1)
+	g2.RegisterRPC("Recv", func(conn modules.PeerConn) error {
+		var payload string
+		err := encoding.ReadObject(conn, &payload, 100)
+		recvChan <- payload
+		return err
+	})
+
+	// Broadcast to g2 and to more peers that g1 is not connected to than can
+	// be called at once.
+	peers := g1.Peers()
+	for i := 0; i <= maxConcurrentBroadcasts; i++ {
+		addr := modules.NetAddress(fmt.Sprintf("111.111.111.111:%v", 10000+i))
+		peers = append(peers, modules.Peer{NetAddress: addr})
+	}
+	errs := g1.BroadcastErrors("Recv", "foo", peers)
+	if len(errs) != maxConcurrentBroadcasts+1 {
+		t.Fatalf("expected %v errors, got %v: %v", maxConcurrentBroadcasts+1, len(errs), errs)
+	} else if _, ok := errs[g2.Address()]; ok {
+		t.Fatal("reachable peer is in the error map:", errs)
+	}
+	select {
+	case payload := <-recvChan:
+		if payload != "foo" {
+			t.Fatal("broadcast failed:", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reachable peer did not receive the broadcast")
+	}
+}
+
+// TestBroadcastDeadPeers checks that peers which fail to receive a broadcast
+// do not delay the broadcast to healthy peers while they wait to be retried.
+func TestBroadcastDeadPeers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newNamedTestingGateway(t, "0")
+	defer g.Close()
+
+	// Interleave a few live peers with many more dead peers than can be
+	// called at once.
+	recvChan := make(chan modules.NetAddress, 3)
+	var peers []modules.Peer
+	var numDead int
+	for i := 1; i <= 3; i++ {
+		for j := 0; j < 2*maxConcurrentBroadcasts; j++ {
+			addr := modules.NetAddress(fmt.Sprintf("111.111.111.111:%v", 10000+numDead))
+			peers = append(peers, modules.Peer{NetAddress: addr})
+			numDead++
+		}
+		live := newNamedTestingGateway(t, strconv.Itoa(i))
+		defer live.Close()
+		if err := g.Connect(live.Address()); err != nil {
+			t.Fatal("failed to connect:", err)
+		}
+		addr := live.Address()
+		live.RegisterRPC("Recv", func(conn modules.PeerConn) error {
+			var payload string
+			err := encoding.ReadObject(conn, &payload, 100)
+			recvChan <- addr
+			return err
+		})
+		peers = append(peers, modules.Peer{NetAddress: addr})
+	}
+
+	errsChan := make(chan map[modules.NetAddress]error)
+	go func() {
+		errsChan <- g.BroadcastErrors("Recv", "foo", peers)
+	}()
+	timeout := time.After(broadcastRetryDelay / 2)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-recvChan:
+		case <-timeout:
+			t.Fatalf("only %v of 3 live peers received the broadcast before the dead peers were retried", i)
+		}
+	}
+	if errs := <-errsChan; len(errs) != numDead {
+		t.Fatalf("expected %v errors, got %v", numDead, len(errs))
+	}
+}
+
 // TestOutboundAndInboundRPCs tests that both inbound and outbound connections
 // can successfully make RPC calls.
 func TestOutboundAndInboundRPCs(t *testing.T) {
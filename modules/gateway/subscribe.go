@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"sync"
+
+	"github.com/NebulousLabs/Sia/build"
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// A subscription is the set of channels that receive the payloads of an RPC.
+type subscription struct {
+	chans  []chan []byte
+	maxLen uint64
+}
+
+// subscriptionHandler returns the RPCFunc that serves a subscribed RPC. It
+// reads a single length-prefixed payload, which is the format written by
+// Broadcast, and delivers it to every subscriber.
+func (g *Gateway) subscriptionHandler(id rpcID) modules.RPCFunc {
+	return func(conn modules.PeerConn) error {
+		g.mu.RLock()
+		sub, ok := g.subscriptions[id]
+		var maxLen uint64
+		if ok {
+			maxLen = sub.maxLen
+		}
+		g.mu.RUnlock()
+		if !ok {
+			return nil
+		}
+
+		payload, err := encoding.ReadPrefix(conn, maxLen)
+		if err != nil {
+			return err
+		}
+
+		// The lock is held while sending so that unsubscribing cannot close a
+		// channel mid-delivery.
+		g.mu.RLock()
+		defer g.mu.RUnlock()
+		for _, c := range sub.chans {
+			select {
+			case c <- payload:
+			default:
+				g.log.Debugf("WARN: dropped payload of RPC \"%v\" from %v, subscriber is not keeping up", id, conn.RPCAddr())
+			}
+		}
+		return nil
+	}
+}
+
+// Subscribe returns a channel that receives the payload of every incoming call
+// to the named RPC, along with a function that cancels the subscription and
+// closes the channel. The RPC must be called with a single length-prefixed
+// payload of at most maxLen bytes, as Broadcast does. Every subscriber of an
+// RPC receives the same payload slice, which must not be modified. The RPC is
+// registered by the first subscription and unregistered when the last
+// subscription is cancelled, so it cannot also be registered with
+// RegisterRPC.
+func (g *Gateway) Subscribe(name string, maxLen uint64) (<-chan []byte, func()) {
+	id := handlerName(name)
+	c := make(chan []byte, subscriberBufferSize)
+
+	g.mu.Lock()
+	sub, ok := g.subscriptions[id]
+	if !ok {
+		if _, ok := g.handlers[id]; ok {
+			build.Critical("RPC already registered: " + name)
+		}
+		sub = new(subscription)
+		g.subscriptions[id] = sub
+		g.handlers[id] = g.subscriptionHandler(id)
+	}
+	sub.chans = append(sub.chans, c)
+	if maxLen > sub.maxLen {
+		sub.maxLen = maxLen
+	}
+	g.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			for i := range sub.chans {
+				if sub.chans[i] == c {
+					sub.chans = append(sub.chans[:i], sub.chans[i+1:]...)
+					break
+				}
+			}
+			close(c)
+			if len(sub.chans) == 0 {
+				delete(g.subscriptions, id)
+				delete(g.handlers, id)
+			}
+		})
+	}
+	return c, unsubscribe
+}
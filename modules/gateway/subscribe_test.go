@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/encoding"
+)
+
+// TestSubscribe checks that every subscriber to an RPC receives broadcast
+// payloads, and that cancelling subscriptions closes their channels and
+// unregisters the RPC.
+func TestSubscribe(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g1 := newNamedTestingGateway(t, "1")
+	defer g1.Close()
+	g2 := newNamedTestingGateway(t, "2")
+	defer g2.Close()
+
+	c1, unsubscribe1 := g2.Subscribe("Foo", 100)
+	c2, unsubscribe2 := g2.Subscribe("Foo", 100)
+
+	if err := g1.Connect(g2.Address()); err != nil {
+		t.Fatal(err)
+	}
+	g1.Broadcast("Foo", "bar", g1.Peers())
+
+	expected := encoding.Marshal("bar")
+	for _, c := range []<-chan []byte{c1, c2} {
+		select {
+		case payload := <-c:
+			if !bytes.Equal(payload, expected) {
+				t.Fatalf("expected %v, got %v", expected, payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("subscriber did not receive the broadcast")
+		}
+	}
+
+	// Cancelling a subscription should close its channel.
+	unsubscribe1()
+	unsubscribe1()
+	if _, ok := <-c1; ok {
+		t.Fatal("channel was not closed after unsubscribing")
+	}
+	isRegistered := func() bool {
+		for _, name := range g2.RegisteredRPCs() {
+			if name == "Foo" {
+				return true
+			}
+		}
+		return false
+	}
+	if !isRegistered() {
+		t.Fatal("RPC was unregistered while it still had a subscriber")
+	}
+
+	// Cancelling the last subscription should unregister the RPC.
+	unsubscribe2()
+	if isRegistered() {
+		t.Fatal("RPC is still registered after its last subscription was cancelled")
+	}
+}
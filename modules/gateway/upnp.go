@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -16,12 +17,21 @@ import (
 	"github.com/NebulousLabs/Sia/modules"
 )
 
-// myExternalIP discovers the gateway's external IP by querying a centralized
-// service, http://myexternalip.com.
-func myExternalIP() (string, error) {
+// externalIPServices is the list of third party services that are queried to
+// discover the gateway's external IP. Each service responds to a GET request
+// with the IP address that the request originated from.
+var externalIPServices = []string{
+	"https://myexternalip.com/raw",
+	"https://api.ipify.org",
+	"https://icanhazip.com",
+}
+
+// fetchExternalIP asks a single third party service for the gateway's external
+// IP.
+func fetchExternalIP(service string) (string, error) {
 	// timeout after 10 seconds
 	client := http.Client{Timeout: time.Duration(10 * time.Second)}
-	resp, err := client.Get("http://myexternalip.com/raw")
+	resp, err := client.Get(service)
 	if err != nil {
 		return "", err
 	}
@@ -34,11 +44,54 @@ func myExternalIP() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if len(buf) == 0 {
-		return "", errors.New("myexternalip.com returned a 0 length IP address")
-	}
 	// trim newline
-	return strings.TrimSpace(string(buf)), nil
+	ip := net.ParseIP(strings.TrimSpace(string(buf)))
+	if ip == nil {
+		return "", fmt.Errorf("%v returned an invalid IP address", service)
+	}
+	return ip.String(), nil
+}
+
+// myExternalIP discovers the gateway's external IP by querying each of the
+// provided services in parallel. To prevent a single service from feeding the
+// gateway a false address, an IP is only returned if it was reported by a
+// majority of the services.
+func myExternalIP(services []string) (string, error) {
+	ipChan := make(chan string, len(services))
+	for _, service := range services {
+		go func(service string) {
+			ip, err := fetchExternalIP(service)
+			if err != nil {
+				ip = ""
+			}
+			ipChan <- ip
+		}(service)
+	}
+	votes := make(map[string]int)
+	for range services {
+		if ip := <-ipChan; ip != "" {
+			votes[ip]++
+		}
+	}
+	for ip, count := range votes {
+		if count > len(services)/2 {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no external IP was reported by a majority of %v services: %v", len(services), votes)
+}
+
+// managedExternalIP asks the provided third party services for the gateway's
+// external IP. The services are contacted directly, so no requests are made if
+// a custom Dialer is set.
+func (g *Gateway) managedExternalIP(services []string) (string, error) {
+	g.mu.RLock()
+	customDialer := g.dialer != nil
+	g.mu.RUnlock()
+	if customDialer {
+		return "", errCustomDialer
+	}
+	return myExternalIP(services)
 }
 
 // threadedLearnHostname discovers the external IP of the Gateway. Once the IP
@@ -54,14 +107,14 @@ func (g *Gateway) threadedLearnHostname() {
 		return
 	}
 
-	// try UPnP first, then fallback to myexternalip.com
+	// try UPnP first, then fall back to third party services
 	var host string
 	d, err := upnp.Discover()
 	if err == nil {
 		host, err = d.ExternalIP()
 	}
 	if err != nil {
-		host, err = myExternalIP()
+		host, err = g.managedExternalIP(externalIPServices)
 	}
 	if err != nil {
 		g.log.Println("WARN: failed to discover external IP:", err)
@@ -79,6 +132,7 @@ func (g *Gateway) threadedLearnHostname() {
 	g.mu.Lock()
 	g.myAddr = addr
 	g.mu.Unlock()
+	g.managedRefreshInterfaceIPs()
 
 	g.log.Println("INFO: our address is", addr)
 }
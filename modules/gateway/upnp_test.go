@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newIPService returns a test server that reports ip as the caller's external
+// IP.
+func newIPService(ip string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, ip)
+	}))
+}
+
+// TestMyExternalIP checks that myExternalIP only accepts an IP that a
+// majority of services agree on.
+func TestMyExternalIP(t *testing.T) {
+	honest1 := newIPService("1.2.3.4")
+	defer honest1.Close()
+	honest2 := newIPService("1.2.3.4")
+	defer honest2.Close()
+	liar := newIPService("5.6.7.8")
+	defer liar.Close()
+	garbage := newIPService("not an ip")
+	defer garbage.Close()
+
+	// Two out of three services agree.
+	ip, err := myExternalIP([]string{honest1.URL, liar.URL, honest2.URL})
+	if err != nil {
+		t.Fatal(err)
+	} else if ip != "1.2.3.4" {
+		t.Fatalf("expected %v, got %v", "1.2.3.4", ip)
+	}
+
+	// No majority.
+	_, err = myExternalIP([]string{honest1.URL, liar.URL, garbage.URL})
+	if err == nil {
+		t.Fatal("expected an error when there is no majority")
+	}
+}
+
+// TestExternalIPCustomDialer checks that the gateway does not contact third
+// party services for its external IP while a custom Dialer is set, since the
+// requests would not go through the Dialer.
+func TestExternalIPCustomDialer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+	g := newTestingGateway(t)
+	defer g.Close()
+
+	var requests uint32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requests, 1)
+		fmt.Fprintln(w, "1.2.3.4")
+	}))
+	defer service.Close()
+
+	ip, err := g.managedExternalIP([]string{service.URL})
+	if err != nil {
+		t.Fatal(err)
+	} else if ip != "1.2.3.4" {
+		t.Fatalf("expected %v, got %v", "1.2.3.4", ip)
+	}
+
+	g.SetDialer(new(recordingDialer))
+	if _, err := g.managedExternalIP([]string{service.URL}); err != errCustomDialer {
+		t.Fatalf("expected %v, got %v", errCustomDialer, err)
+	}
+	if n := atomic.LoadUint32(&requests); n != 1 {
+		t.Fatalf("expected 1 request to the service, got %v", n)
+	}
+}
@@ -18,6 +18,17 @@ const MaxEncodedNetAddressLength = 266
 // A NetAddress contains the information needed to contact a peer.
 type NetAddress string
 
+// Network returns the name of the network that a NetAddress is dialed on. Along
+// with String, it allows a NetAddress to be used as a net.Addr.
+func (na NetAddress) Network() string {
+	return "tcp"
+}
+
+// String returns the NetAddress as a string.
+func (na NetAddress) String() string {
+	return string(na)
+}
+
 // Host removes the port from a NetAddress, returning just the host. If the
 // address is not of the form "host:port" the empty string is returned. The
 // port will still be returned for invalid NetAddresses (e.g. "unqualified:0"
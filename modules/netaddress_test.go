@@ -100,6 +100,19 @@ var (
 	}
 )
 
+// TestNetAddressIsNetAddr checks that a NetAddress can be used as a net.Addr.
+func TestNetAddressIsNetAddr(t *testing.T) {
+	t.Parallel()
+
+	var addr net.Addr = NetAddress("foo.com:9981")
+	if addr.Network() != "tcp" {
+		t.Errorf("expected network %q, got %q", "tcp", addr.Network())
+	}
+	if addr.String() != "foo.com:9981" {
+		t.Errorf("expected address %q, got %q", "foo.com:9981", addr.String())
+	}
+}
+
 // TestHostPort tests the Host and Port methods of the NetAddress type.
 func TestHostPort(t *testing.T) {
 	t.Parallel()
@@ -131,6 +144,19 @@ func TestHostPort(t *testing.T) {
 	if port != "" {
 		t.Error("expected Port() to return blank for an un-splittable NetAddress, but it returned:", port)
 	}
+
+	// Test that the zone of a link-local IPv6 address is kept as part of the
+	// host, so that the address survives being split and joined again.
+	na = NetAddress("[fe80::1%eth0]:9981")
+	if host := na.Host(); host != "fe80::1%eth0" {
+		t.Error("Host() did not keep the IPv6 zone:", host)
+	}
+	if port := na.Port(); port != "9981" {
+		t.Error("Port() returned unexpected port for a zoned IPv6 address:", port)
+	}
+	if rt := NetAddress(net.JoinHostPort(na.Host(), na.Port())); rt != na {
+		t.Errorf("zoned IPv6 address did not round trip: expected %v, got %v", na, rt)
+	}
 }
 
 // TestIsLoopback tests the IsLoopback method of the NetAddress type.